@@ -0,0 +1,127 @@
+// Copyright 2012 Lawrence Kesteloot
+
+package main
+
+// Turn tokenized Level II BASIC programs back into text.
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Level II BASIC tokens, starting at 0x80.
+var basicTokens = []string{
+	"END", "FOR", "RESET", "SET", "CLS", "CMD", "RANDOM", "NEXT", // 0x80
+	"DATA", "INPUT", "DIM", "READ", "LET", "GOTO", "RUN", "IF", // 0x88
+	"RESTORE", "GOSUB", "RETURN", "REM", "STOP", "ELSE", "TRON", "TROFF", // 0x90
+	"DEFSTR", "DEFINT", "DEFSNG", "DEFDBL", "LINE", "EDIT", "ERROR", "RESUME", // 0x98
+	"OUT", "ON", "OPEN", "FIELD", "GET", "PUT", "CLOSE", "LOAD", // 0xA0
+	"MERGE", "NAME", "KILL", "LSET", "RSET", "SAVE", "SYSTEM", "LPRINT", // 0xA8
+	"DEF", "POKE", "PRINT", "CONT", "LIST", "LLIST", "DELETE", "AUTO", // 0xB0
+	"CLEAR", "CLOAD", "CSAVE", "NEW", "TAB(", "TO", "FN", "USING", // 0xB8
+	"VARPTR", "USR", "ERL", "ERR", "STRING$", "INSTR", "POINT", "TIME$", // 0xC0
+	"MEM", "INKEY$", "THEN", "NOT", "STEP", "+", "-", "*", // 0xC8
+	"/", "[", "AND", "OR", ">", "=", "<", "SGN", // 0xD0
+	"INT", "ABS", "FRE", "INP", "POS", "SQR", "RND", "LOG", // 0xD8
+	"EXP", "COS", "SIN", "TAN", "ATN", "PEEK", "CVI", "CVS", // 0xE0
+	"CVD", "EOF", "LOC", "LOF", "MKI$", "MKS$", "MKD$", "CINT", // 0xE8
+	"CSNG", "CDBL", "FIX", "LEN", "STR$", "VAL", "ASC", "CHR$", // 0xF0
+	"LEFT$", "RIGHT$", "MID$", "'", // 0xF8
+}
+
+// Tokens that need special handling.
+const (
+	basicTokenData   = 0x88
+	basicTokenRem    = 0x93
+	basicTokenElse   = 0x95
+	basicTokenRemark = 0xFB // The ' abbreviation for REM.
+)
+
+// A line of a BASIC program.
+type basicLine struct {
+	number uint16
+	text   string
+}
+
+// Parse a tokenized program, as saved on tape after the header. Each line
+// is a pointer to the next line (zero at the end of the program), the line
+// number, and the tokenized text ended by a zero. Returns the lines and the
+// number of bytes used.
+func parseBasic(data []byte) ([]basicLine, int, error) {
+	var lines []basicLine
+
+	i := 0
+	for {
+		if i+2 > len(data) {
+			return lines, i, fmt.Errorf("Program is truncated")
+		}
+		if data[i] == 0 && data[i+1] == 0 {
+			// End of program.
+			return lines, i + 2, nil
+		}
+		if i+4 > len(data) {
+			return lines, i, fmt.Errorf("Program is truncated")
+		}
+		number := uint16(data[i+2]) | uint16(data[i+3])<<8
+
+		end := bytes.IndexByte(data[i+4:], 0)
+		if end == -1 {
+			return lines, i, fmt.Errorf("Line %d is truncated", number)
+		}
+		lines = append(lines, basicLine{number, detokenizeBasic(data[i+4 : i+4+end])})
+		i += 4 + end + 1
+	}
+}
+
+// Convert the tokenized text of a line to a string.
+func detokenizeBasic(b []byte) string {
+	var text bytes.Buffer
+
+	// Write a character that's not a token.
+	writeChar := func(ch byte) {
+		if ch >= 0x20 && ch < 0x80 {
+			text.WriteByte(ch)
+		} else {
+			text.WriteString(printableChar(ch))
+		}
+	}
+
+	inString := false
+	inRemark := false
+	inData := false
+	for i := 0; i < len(b); i++ {
+		ch := b[i]
+
+		switch {
+		case inRemark:
+			writeChar(ch)
+		case inString:
+			writeChar(ch)
+			inString = ch != '"'
+		case ch == ':':
+			// The ' and ELSE tokens are stored after a colon, which isn't
+			// listed.
+			if i+2 < len(b) && b[i+1] == basicTokenRem && b[i+2] == basicTokenRemark {
+				text.WriteByte('\'')
+				inRemark = true
+				i += 2
+			} else if i+1 >= len(b) || b[i+1] != basicTokenElse {
+				text.WriteByte(ch)
+			}
+			inData = false
+		case ch == '"':
+			writeChar(ch)
+			inString = true
+		case ch < 0x80 || inData:
+			writeChar(ch)
+		case int(ch-0x80) < len(basicTokens):
+			text.WriteString(basicTokens[ch-0x80])
+			inRemark = ch == basicTokenRem || ch == basicTokenRemark
+			inData = ch == basicTokenData
+		default:
+			writeChar(ch)
+		}
+	}
+
+	return text.String()
+}
@@ -0,0 +1,366 @@
+// Copyright 2012 Lawrence Kesteloot
+
+package main
+
+// Support for CAS cassette images, which hold the bits on the tape instead of
+// its sound. When reading, we synthesize the samples that the tape would have
+// produced. When recording, we decode the bits from the pulses written by the
+// program.
+//
+// At 250 and 500 baud, each bit starts with a clock pulse, and a 1 bit has a
+// second pulse halfway through. At 1500 baud, each bit is one cycle of a
+// square wave, short for a 1 and long for a 0. Low-speed tapes start with a
+// leader of 0x00 bytes and a 0xA5 sync byte, high-speed tapes with a leader
+// of 0x55 bytes and a 0x7F sync byte. Bytes are stored most significant bit
+// first.
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"sort"
+)
+
+const (
+	// Sample rate of synthesized tapes.
+	casSampleRate = 44100
+
+	// Timing of the tape, in seconds.
+	casPulseWidth   = 0.000125 // Each half of a low-speed pulse.
+	casBitTime500   = 0.002    // Bit at 500 baud. Twice as long at 250.
+	casZeroTime1500 = 0.001    // 0 bit at 1500 baud.
+	casOneTime1500  = 0.0005   // 1 bit at 1500 baud.
+
+	// Leader and sync bytes.
+	casLowSpeedLeader  = 0x00
+	casLowSpeedSync    = 0xA5
+	casHighSpeedLeader = 0x55
+	casHighSpeedSync   = 0x7F
+)
+
+// Reads a CAS file and synthesizes its samples.
+type casFile struct {
+	data        []byte
+	baud        int
+	bitIndex    int     // Next bit to synthesize.
+	samples     []int16 // Samples of the current bit not yet read.
+	position    float64 // Sample number where the next bit starts.
+	sampleCount int     // Samples synthesized so far.
+	isEof       bool
+}
+
+// Loads a CAS file. Low-speed tapes are assumed to be at the given baud rate.
+func openCas(filename string, lowSpeedBaud int) (*casFile, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &casFile{data: data, baud: casBaud(data, lowSpeedBaud)}
+	log.Printf("Loaded %d-baud CAS cassette \"%s\" (%d bytes)", c.baud, filename, len(data))
+
+	return c, nil
+}
+
+// Guess the speed of a tape from its leader. Level I tapes (250 baud) look
+// just like 500-baud ones, so the caller says which low speed to use.
+func casBaud(data []byte, lowSpeedBaud int) int {
+	count := 0
+	for i := 0; i < len(data) && i < 16; i++ {
+		if data[i] == casHighSpeedLeader {
+			count++
+		}
+	}
+	if count > 8 {
+		return 1500
+	}
+
+	return lowSpeedBaud
+}
+
+// Return the number of samples per second.
+func (c *casFile) sampleRate() uint32 {
+	return casSampleRate
+}
+
+// Go to the given sample.
+func (c *casFile) seekSample(n int) error {
+	// Find the bit that the sample is in.
+	c.bitIndex = 0
+	c.samples = nil
+	c.position = 0
+	c.isEof = false
+	for c.bitIndex < 8*len(c.data) {
+		length := casBitLength(c.bit(c.bitIndex), c.baud) * casSampleRate
+		if c.position+length > float64(n) {
+			break
+		}
+		c.position += length
+		c.bitIndex++
+	}
+	c.sampleCount = int(math.Ceil(c.position))
+
+	// Skip the start of that bit.
+	for i := c.sampleCount; i < n; i++ {
+		_, err := c.readSample()
+		if err != nil {
+			break
+		}
+	}
+
+	return nil
+}
+
+// Nothing to close, the file has been read.
+func (c *casFile) close() error {
+	return nil
+}
+
+// Return the value of the given bit of the tape.
+func (c *casFile) bit(bitIndex int) bool {
+	return c.data[bitIndex/8]&(0x80>>uint(bitIndex%8)) != 0
+}
+
+// Return the next synthesized sample.
+func (c *casFile) readSample() (int16, error) {
+	for len(c.samples) == 0 {
+		if c.bitIndex >= 8*len(c.data) {
+			if !c.isEof {
+				log.Print("End of cassette")
+				c.isEof = true
+			}
+			return 0, io.EOF
+		}
+		c.synthesizeBit(c.bit(c.bitIndex))
+		c.bitIndex++
+	}
+
+	s := c.samples[0]
+	c.samples = c.samples[1:]
+	return s, nil
+}
+
+// Length of a bit in seconds.
+func casBitLength(bit bool, baud int) float64 {
+	if baud == 1500 {
+		if bit {
+			return casOneTime1500
+		}
+		return casZeroTime1500
+	}
+
+	return casBitTime500 * 500 / float64(baud)
+}
+
+// Return when each byte starts on the tape, and when the tape ends, in
+// seconds.
+func casByteTimes(data []byte, baud int) (times []float64, end float64) {
+	times = make([]float64, len(data))
+	for i, b := range data {
+		times[i] = end
+		for bit := 0; bit < 8; bit++ {
+			end += casBitLength(b&(0x80>>uint(bit)) != 0, baud)
+		}
+	}
+
+	return
+}
+
+// Append the samples of one bit to the samples array.
+func (c *casFile) synthesizeBit(bit bool) {
+	// Length of the bit in seconds, and level at a time within the bit.
+	length := casBitLength(bit, c.baud)
+	var level func(t float64) int16
+	if c.baud == 1500 {
+		level = func(t float64) int16 {
+			if t < length/2 {
+				return cassetteRecordLevel
+			}
+			return -cassetteRecordLevel
+		}
+	} else {
+		level = func(t float64) int16 {
+			// The data pulse looks like the clock pulse.
+			if bit && t >= length/2 {
+				t -= length / 2
+			}
+			if t < casPulseWidth {
+				return cassetteRecordLevel
+			} else if t < 2*casPulseWidth {
+				return -cassetteRecordLevel
+			}
+			return 0
+		}
+	}
+
+	start := c.position
+	c.position += length * casSampleRate
+	for float64(c.sampleCount) < c.position {
+		t := (float64(c.sampleCount) - start) / casSampleRate
+		c.samples = append(c.samples, level(t))
+		c.sampleCount++
+	}
+}
+
+// Records a cassette to a CAS file. We keep the times at which the output
+// went positive and decode them when the recording is closed.
+type casWriter struct {
+	filename  string
+	lastValue byte
+	lastTime  float64
+	rises     []float64
+	lastFall  float64 // When the output last stopped being negative.
+}
+
+// Creates a CAS file recorder. Nothing is written until close().
+func createCas(filename string) *casWriter {
+	return &casWriter{filename: filename}
+}
+
+// The output had the given value until the given time, in seconds.
+func (w *casWriter) writeValue(value byte, until float64) error {
+	if value == 1 && w.lastValue != 1 {
+		w.rises = append(w.rises, w.lastTime)
+	}
+	if value == 2 {
+		w.lastFall = until
+	}
+	w.lastValue = value
+	w.lastTime = until
+
+	return nil
+}
+
+// Decode the bits and write the file.
+func (w *casWriter) close() error {
+	data, _ := casBytes(decodeCasBits(w.rises, w.lastFall))
+	return ioutil.WriteFile(w.filename, data, 0666)
+}
+
+// Decode the bits from the times at which the output went positive. The end
+// is when the last pulse or cycle finished. Also returns when each bit
+// started.
+func decodeCasBits(rises []float64, end float64) (bits []bool, times []float64) {
+	if len(rises) < 2 {
+		return
+	}
+
+	shortest, longest, median := leaderIntervals(rises)
+
+	if longest > 1.5*shortest {
+		// High speed. Each interval is a bit, and the last one ends with the
+		// end of the last cycle.
+		threshold := (shortest + longest) / 2
+		if end > rises[len(rises)-1] {
+			rises = append(rises, end)
+		}
+		for i := 1; i < len(rises); i++ {
+			interval := rises[i] - rises[i-1]
+			if interval < threshold {
+				bits = append(bits, true)
+				times = append(times, rises[i-1])
+			} else if interval < 2*longest {
+				bits = append(bits, false)
+				times = append(times, rises[i-1])
+			}
+			// Otherwise it's a gap between blocks.
+		}
+	} else {
+		// Low speed. A pulse in the first half of a bit is a data pulse.
+		bitTime := median
+		clock := rises[0]
+		bit := false
+		for _, rise := range rises[1:] {
+			interval := rise - clock
+			if interval < 0.75*bitTime {
+				bit = true
+			} else {
+				bits = append(bits, bit)
+				times = append(times, clock)
+				clock = rise
+				bit = false
+			}
+		}
+		bits = append(bits, bit)
+		times = append(times, clock)
+	}
+
+	return
+}
+
+// Look at the intervals between the rising edges of the leader. At low speed
+// it's all clock pulses a bit apart. At high speed it's alternating 0 and 1
+// bits, so the intervals alternate between long and short. There must be at
+// least two rises.
+func leaderIntervals(rises []float64) (shortest, longest, median float64) {
+	var intervals []float64
+	for i := 1; i < len(rises) && i <= 64; i++ {
+		intervals = append(intervals, rises[i]-rises[i-1])
+	}
+	sort.Float64s(intervals)
+
+	return intervals[0], intervals[len(intervals)-1], intervals[len(intervals)/2]
+}
+
+// Guess the baud rate from the rising edges of the leader, or return 0 if
+// there aren't enough of them.
+func guessCasBaud(rises []float64) int {
+	if len(rises) < 2 {
+		return 0
+	}
+
+	shortest, longest, median := leaderIntervals(rises)
+	if longest > 1.5*shortest {
+		return 1500
+	} else if median > 1.5*casBitTime500 {
+		return 250
+	}
+
+	return 500
+}
+
+// Turn the decoded bits into bytes, aligned so that the sync byte after the
+// leader is a whole byte. The times of the bits become the times of the
+// bytes.
+func casBytes(bits []bool, bitTimes []float64) (data []byte, times []float64) {
+	// Find the sync byte.
+	syncIndex := -1
+	var leader byte
+	for i := 0; i+8 <= len(bits) && syncIndex == -1; i++ {
+		switch bitsToByte(bits[i : i+8]) {
+		case casLowSpeedSync:
+			syncIndex, leader = i, casLowSpeedLeader
+		case casHighSpeedSync:
+			syncIndex, leader = i, casHighSpeedLeader
+		}
+	}
+	if syncIndex == -1 {
+		log.Print("Didn't find sync byte in cassette")
+		syncIndex = 0
+	} else {
+		for i := syncIndex % 8; i < syncIndex; i += 8 {
+			data = append(data, leader)
+			times = append(times, bitTimes[i])
+		}
+	}
+
+	for i := syncIndex; i+8 <= len(bits); i += 8 {
+		data = append(data, bitsToByte(bits[i:i+8]))
+		times = append(times, bitTimes[i])
+	}
+
+	return
+}
+
+// Convert eight bits, most significant first, to a byte.
+func bitsToByte(bits []bool) byte {
+	var b byte
+	for _, bit := range bits {
+		b <<= 1
+		if bit {
+			b |= 1
+		}
+	}
+	return b
+}
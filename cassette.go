@@ -2,20 +2,74 @@
 
 package main
 
+import (
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"time"
+)
+
 const (
-	// Threshold for 16-bit signed samples.
-	cassetteThreshold = 5000
+	// Sample rate and amplitude of recorded cassettes.
+	cassetteRecordRate  = 44100
+	cassetteRecordLevel = 20000
 )
 
-// State of the hardware. We don't support writing.
+// State of the hardware.
 type cassetteState int
 
 const (
 	cassetteStateClose = cassetteState(iota)
 	cassetteStateRead
+	cassetteStateWrite
 	cassetteStateFail
 )
 
+// Source of cassette samples, either a WAV file or a synthesized CAS image.
+// Past the end of the tape, readSample returns io.EOF.
+type cassetteReader interface {
+	sampleRate() uint32
+	readSample() (int16, error)
+	seekSample(n int) error
+	close() error
+}
+
+// Destination of a recording, either a WAV file or a CAS image.
+type cassetteWriter interface {
+	// The output had the given value (0 to 3) until the given time, in
+	// seconds since the start of the recording.
+	writeValue(value byte, until float64) error
+	close() error
+}
+
+// Records a cassette to a WAV file.
+type cassetteWavWriter struct {
+	*wavWriter
+}
+
+// Write samples of the value until the given time.
+func (w cassetteWavWriter) writeValue(value byte, until float64) error {
+	var s int16
+	switch value {
+	case 1:
+		s = cassetteRecordLevel
+	case 2:
+		s = -cassetteRecordLevel
+	}
+
+	samplesToWrite := int(until * float64(w.samplesPerSecond))
+	for w.sampleCount < samplesToWrite {
+		err := w.writeSample(s)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // Value of wave in audio: negative, neutral (around zero), or positive.
 type cassetteValue int
 
@@ -27,14 +81,21 @@ const (
 
 // Internal state of the cassette controller.
 type cassetteController struct {
-	// Filename to read for cassette data. This should be a WAV file.
+	// Filename to read for cassette data. This should be a WAV or CAS file.
 	filename string
 
 	// Whether the motor is running.
 	motorOn bool
 
-	// Information about the cassette itself.
-	cassette *wavFile
+	// Information about the cassette itself, and how we turn its samples
+	// into values. The cassette stays open while it's in the recorder.
+	cassette cassetteReader
+	decoder  *cassetteDecoder
+
+	// Position of the tape, as the next sample to read, and the last
+	// position we showed in the UI, in seconds.
+	tapeSample    int
+	shownPosition int
 
 	// State machine.
 	state cassetteState
@@ -44,10 +105,22 @@ type cassetteController struct {
 	lastNonZero cassetteValue
 	flipFlop    bool
 
-	// When we turned on the motor (started reading the file) and how many samples
-	// we've read since then.
+	// When we turned on the motor (started reading or recording the file) and
+	// how many samples we've read since then.
 	motorOnClock uint64
 	samplesRead  int
+
+	// Bytes of the tape, for fast loading and the list of blocks. Decoding
+	// a long recording takes a while, so it's done in the background and
+	// the result comes through tapeCh. That's nil when we're not waiting.
+	tape   *cassetteTape
+	tapeCh chan tapeDecoding
+
+	// Recording. The output value is the last two bits written to the port.
+	// It's recorded at each change of value.
+	recording      cassetteWriter
+	recordFilename string
+	outputValue    byte
 }
 
 // Reset the controller to a known state.
@@ -60,7 +133,8 @@ func (vm *vm) getCassetteByte() byte {
 	cc := &vm.cc
 
 	// If the motor's running, and we're reading a byte, then get into read mode.
-	if cc.motorOn {
+	// Programs that are writing can read too.
+	if cc.motorOn && cc.state != cassetteStateWrite {
 		vm.setCassetteState(cassetteStateRead)
 	}
 
@@ -78,8 +152,10 @@ func (vm *vm) getCassetteByte() byte {
 	return b
 }
 
-// Write to the cassette port. We don't support writing tapes, but this is used
-// for 500-baud reading to trigger the next analysis of the tape.
+// Write to the cassette port. This is used for 500-baud reading to trigger the
+// next analysis of the tape. Otherwise, a change of output value starts or
+// continues a recording. The value is 1 for a positive pulse, 2 for negative,
+// and 0 or 3 for neutral.
 func (vm *vm) putCassetteByte(b byte) {
 	cc := &vm.cc
 
@@ -88,6 +164,31 @@ func (vm *vm) putCassetteByte(b byte) {
 			vm.updateCassette()
 			cc.flipFlop = false
 		}
+		// Start recording at the first pulse (1 or 2), not when the
+		// output is merely set to 0 or 3, which sound the same.
+		if cc.state != cassetteStateRead && b != cc.outputValue &&
+			(cc.state == cassetteStateWrite || b == 1 || b == 2) &&
+			vm.setCassetteState(cassetteStateWrite) >= 0 {
+
+			// Finish the previous value.
+			vm.recordCassette()
+		}
+	}
+
+	cc.outputValue = b
+}
+
+// Record the current output value up to the current clock.
+func (vm *vm) recordCassette() {
+	cc := &vm.cc
+
+	seconds := float64(vm.clock-cc.motorOnClock) / float64(vm.cpuHz())
+	err := cc.recording.writeValue(cc.outputValue, seconds)
+	if err != nil {
+		log.Printf("Can't write to cassette \"%s\": %s", cc.recordFilename, err)
+		cc.recording.close()
+		cc.recording = nil
+		cc.state = cassetteStateFail
 	}
 }
 
@@ -112,7 +213,7 @@ func (vm *vm) setCassetteMotor(motorOn bool) {
 			cc.lastNonZero = cassetteNeutral
 
 			// Wait one second, then kick off reading.
-			vm.addEvent(eventKickOffCassette, func() { vm.kickOffCassette() }, cpuHz)
+			vm.addEvent(eventKickOffCassette, func() { vm.kickOffCassette() }, vm.cpuHz())
 		} else {
 			vm.setCassetteState(cassetteStateClose)
 		}
@@ -125,25 +226,32 @@ func (vm *vm) setCassetteMotor(motorOn bool) {
 func (vm *vm) updateCassette() {
 	cc := &vm.cc
 
-	if cc.motorOn && vm.setCassetteState(cassetteStateRead) >= 0 {
+	if cc.motorOn && cc.state == cassetteStateRead {
 		// See how many samples we should have read by now.
 		samplesToRead := int((vm.clock - cc.motorOnClock) *
-			uint64(cc.cassette.samplesPerSecond) / cpuHz)
+			uint64(cc.cassette.sampleRate()) / vm.cpuHz())
 
 		// Catch up.
 		for cc.samplesRead < samplesToRead {
 			s, err := cc.cassette.readSample()
-			if err != nil {
-				panic(err)
+			if err == nil {
+				cc.tapeSample++
+			} else if err == io.EOF {
+				// Pretend that the tape stopped and that we're just
+				// reading silence. That's probably what the original
+				// computer did.
+				s = 0
+			} else {
+				vm.showError(fmt.Errorf("Can't read cassette \"%s\": %s", cc.filename, err))
+				cc.state = cassetteStateFail
+				return
 			}
 			cc.samplesRead++
 
 			// Convert to state, where neutral is some noisy in-between state.
-			value := cassetteNeutral
-			if s > cassetteThreshold {
-				value = cassettePositive
-			} else if s < cassetteThreshold {
-				value = cassetteNegative
+			value := cc.decoder.decode(s)
+			if *cassetteDiagnostics && cc.decoder.leaderFound() {
+				vm.showMessage(cc.decoder.report())
 			}
 
 			// See if we've changed value.
@@ -164,6 +272,8 @@ func (vm *vm) updateCassette() {
 				}
 			}
 		}
+
+		vm.updateCassettePosition(false)
 	}
 }
 
@@ -181,30 +291,206 @@ func (vm *vm) setCassetteState(newState cassetteState) int {
 		return -1
 	}
 
+	// Finish what we were doing.
+	switch oldState {
+	case cassetteStateRead:
+		if *cassetteDiagnostics {
+			vm.showMessage(vm.cc.decoder.report())
+		}
+	case cassetteStateWrite:
+		vm.closeCassetteRecording()
+	}
+
 	// Change things based on new state.
 	switch newState {
 	case cassetteStateRead:
-		vm.openCassetteFile()
+		err := vm.startCassetteRead()
+		if err != nil {
+			vm.showError(err)
+			newState = cassetteStateFail
+		}
+	case cassetteStateWrite:
+		err := vm.createCassetteRecording()
+		if err != nil {
+			log.Printf("Can't record cassette: %s", err)
+			newState = cassetteStateFail
+		}
 	}
 
 	// Update state.
 	vm.cc.state = newState
+	if newState == cassetteStateFail {
+		return -1
+	}
 	return 0
 }
 
-// Open file, get metadata, and get read to read the tape.
-func (vm *vm) openCassetteFile() {
+// Get ready to read the tape from where it is.
+func (vm *vm) startCassetteRead() error {
 	cc := &vm.cc
 
-	cassette, err := openWav(*cassettesDir + "/" + cc.filename)
-	if err != nil {
-		panic(err)
+	if cc.cassette == nil {
+		return fmt.Errorf("No cassette loaded")
 	}
 
 	// Reset the clock.
-	cc.cassette = cassette
 	cc.motorOnClock = vm.clock
 	cc.samplesRead = 0
+
+	return nil
+}
+
+// Put a cassette into the recorder, or take it out if the filename is empty.
+func (vm *vm) loadCassette(filename string) {
+	cc := &vm.cc
+
+	// Stop what we were doing with the old one.
+	vm.setCassetteState(cassetteStateClose)
+
+	if cc.cassette != nil {
+		cc.cassette.close()
+	}
+	cc.filename = filename
+	cc.cassette = nil
+	cc.tape = nil
+	cc.tapeCh = nil
+	cc.tapeSample = 0
+
+	if filename != "" {
+		cassette, err := vm.openCassette(filename)
+		if err != nil {
+			vm.showError(err)
+		} else {
+			cc.cassette = cassette
+			cc.decoder = newCassetteDecoder(cassette.sampleRate(), *invertCassette)
+
+			// Buffered so that the goroutine can finish even if this
+			// cassette is swapped out before we receive from it.
+			tapeCh := make(chan tapeDecoding, 1)
+			cc.tapeCh = tapeCh
+			pathname := *cassettesDir + "/" + filename
+			baud := vm.machine.cassetteBaud
+			go func() {
+				tape, err := decodeTape(pathname, baud)
+				tapeCh <- tapeDecoding{tape, err}
+			}()
+		}
+	}
+
+	vm.updateCassetteBlocks()
+	vm.updateCassettePosition(true)
+}
+
+// Use the bytes of the tape that were decoded in the background.
+func (vm *vm) setCassetteTape(decoding tapeDecoding) {
+	cc := &vm.cc
+
+	cc.tapeCh = nil
+	if decoding.err != nil {
+		vm.showError(decoding.err)
+		return
+	}
+	cc.tape = decoding.tape
+
+	vm.updateCassetteBlocks()
+}
+
+// Wind the tape to the given position, in seconds.
+func (vm *vm) seekCassette(seconds float64) {
+	cc := &vm.cc
+
+	if cc.cassette == nil {
+		return
+	}
+
+	sample := secondsToSamples(seconds, cc.cassette.sampleRate())
+	if sample < 0 {
+		sample = 0
+	}
+	err := cc.cassette.seekSample(sample)
+	if err != nil {
+		vm.showError(fmt.Errorf("Can't wind cassette \"%s\": %s", cc.filename, err))
+		return
+	}
+	cc.tapeSample = sample
+	cc.decoder = newCassetteDecoder(cc.cassette.sampleRate(), *invertCassette)
+
+	// If we're reading, continue from here.
+	cc.motorOnClock = vm.clock
+	cc.samplesRead = 0
+
+	vm.updateCassettePosition(false)
+}
+
+// Open a WAV or CAS file in the cassettes directory.
+func (vm *vm) openCassette(filename string) (cassetteReader, error) {
+	if filename == "" {
+		return nil, fmt.Errorf("No cassette loaded")
+	}
+
+	return openCassetteFile(*cassettesDir+"/"+filename, vm.machine.cassetteBaud)
+}
+
+// Open a WAV or CAS file, depending on its extension. Low-speed CAS files
+// are played at the given baud rate.
+func openCassetteFile(pathname string, lowSpeedBaud int) (cassetteReader, error) {
+	var cassette cassetteReader
+	var err error
+	if strings.ToLower(path.Ext(pathname)) == ".cas" {
+		cassette, err = openCas(pathname, lowSpeedBaud)
+	} else {
+		cassette, err = openWav(pathname)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return cassette, nil
+}
+
+// Create a timestamped WAV or CAS file in the cassettes directory to record
+// to, depending on the -record flag.
+func (vm *vm) createCassetteRecording() error {
+	cc := &vm.cc
+
+	filename := fmt.Sprintf("recording-%s.%s", time.Now().Format("20060102-150405"), *recordFormat)
+	pathname := *cassettesDir + "/" + filename
+	switch *recordFormat {
+	case "wav":
+		wav, err := createWav(pathname, cassetteRecordRate)
+		if err != nil {
+			return err
+		}
+		cc.recording = cassetteWavWriter{wav}
+	case "cas":
+		cc.recording = createCas(pathname)
+	default:
+		return fmt.Errorf("Unknown cassette recording format \"%s\"", *recordFormat)
+	}
+
+	log.Printf("Recording cassette to \"%s\"", filename)
+	cc.recordFilename = filename
+	cc.motorOnClock = vm.clock
+
+	return nil
+}
+
+// Write the rest of the recording and close it.
+func (vm *vm) closeCassetteRecording() {
+	cc := &vm.cc
+
+	vm.recordCassette()
+	err := cc.recording.close()
+	cc.recording = nil
+	if err != nil {
+		log.Printf("Can't write to cassette \"%s\": %s", cc.recordFilename, err)
+		return
+	}
+
+	log.Printf("Saved cassette \"%s\"", cc.recordFilename)
+	if vm.vmUpdateCh != nil {
+		vm.vmUpdateCh <- vmUpdate{Cmd: "cassette_saved", Msg: cc.recordFilename}
+	}
 }
 
 // Update the status of the red light on the display.
@@ -216,5 +502,41 @@ func (vm *vm) updateCassetteMotorLight() {
 		motorOnInt = 0
 	}
 
-	vm.vmUpdateCh <- vmUpdate{Cmd: "motor", Addr: -1, Data: motorOnInt}
+	if vm.vmUpdateCh != nil {
+		vm.vmUpdateCh <- vmUpdate{Cmd: "motor", Addr: -1, Data: motorOnInt}
+	}
+}
+
+// Show the position of the tape if it's changed by a second or more, or if
+// forced. The position is sent in milliseconds.
+func (vm *vm) updateCassettePosition(force bool) {
+	cc := &vm.cc
+
+	sampleRate := 1
+	if cc.cassette != nil {
+		sampleRate = int(cc.cassette.sampleRate())
+	}
+
+	position := cc.tapeSample / sampleRate
+	if (force || position != cc.shownPosition) && vm.vmUpdateCh != nil {
+		vm.vmUpdateCh <- vmUpdate{Cmd: "cassette_position", Data: cc.tapeSample * 1000 / sampleRate}
+	}
+	cc.shownPosition = position
+}
+
+// Send the list of blocks on the tape, with their positions in milliseconds.
+func (vm *vm) updateCassetteBlocks() {
+	if vm.vmUpdateCh == nil {
+		return
+	}
+
+	var blocks []tapeBlock
+	if vm.cc.tape != nil {
+		blocks = vm.cc.tape.blocks
+	}
+
+	vm.vmUpdateCh <- vmUpdate{Cmd: "cassette_blocks", Data: len(blocks)}
+	for i, block := range blocks {
+		vm.vmUpdateCh <- vmUpdate{Cmd: "cassette_block", Addr: i, Data: int(block.time * 1000), Msg: block.name}
+	}
 }
@@ -18,7 +18,6 @@ const (
 	wavDebug          = false
 	crashOnRomWrite   = false
 	logOnRomWrite     = false
-	goFullSpeed       = false
 )
 
 // Same as above but can be changed at runtime. This is for
@@ -66,7 +65,7 @@ func (vm *vm) explainLine(pc, hl uint16, a byte) {
 			msg := ""
 			addr := hl
 			for {
-				ch := vm.memory[addr]
+				ch := vm.peekMem(addr)
 				msg += printableChar(ch)
 
 				// Strings are terminated by 0x03 (not printed) or 0x0D (printed).
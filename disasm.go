@@ -7,6 +7,24 @@ import (
 	"github.com/remogatto/z80"
 )
 
+// Memory as the disassembler sees it, through peekMem(), so that
+// disassembling doesn't change the machine's state or clock.
+type peekMemory struct {
+	*vm
+}
+
+func (m peekMemory) ReadByte(address uint16) byte {
+	return m.peekMem(address)
+}
+
+func (m peekMemory) ReadByteInternal(address uint16) byte {
+	return m.peekMem(address)
+}
+
+func (m peekMemory) Read(address uint16) byte {
+	return m.peekMem(address)
+}
+
 // Disassemble the instruction at the given pc and return the address,
 // machine language, and instruction. Return the PC of the following
 // instruction in nextPc.
@@ -17,7 +35,7 @@ func (vm *vm) disasm(pc uint16) (line string, nextPc uint16) {
 
 	// Disassemble the instruction.
 	for {
-		asm, nextPc, shift = z80.Disassemble(vm, pc, shift)
+		asm, nextPc, shift = z80.Disassemble(peekMemory{vm}, pc, shift)
 
 		// Keep going as long as shift != 0. This is for extended instructions like 0xCB.
 		if shift == 0 {
@@ -31,7 +49,7 @@ func (vm *vm) disasm(pc uint16) (line string, nextPc uint16) {
 	// Machine language.
 	for addr := pc; addr < pc+4; addr++ {
 		if addr < nextPc {
-			line += fmt.Sprintf("%02X ", vm.memory[addr])
+			line += fmt.Sprintf("%02X ", vm.peekMem(addr))
 		} else {
 			line += fmt.Sprint("   ")
 		}
@@ -2,9 +2,11 @@
 
 package main
 
-// Implementation of the TRS-80 Model III floppy disk controller. This file
-// borrows heavily from the xtrs file trs_disk.c. We support both JV1 and JV3
-// file formats, but JV1 is untested.
+// Implementation of the TRS-80 floppy disk controllers: the Model III's
+// WD1793 and the Model I's single-density WD1771. This file
+// borrows heavily from the xtrs file trs_disk.c. We support the JV1, JV3, and
+// DMK file formats, but JV1 is untested. Sectors that are written are saved
+// back to the file.
 //
 // JV1 is a Model I format that's just the sectors laid out end to end. There
 // are 35 tracks, 10 sectors per track, and 256 bytes per sector.
@@ -17,12 +19,17 @@ package main
 // structures. The first byte is the track number, the second is the sector
 // number within that track, and the third is some flags that specify the size
 // of the sector. See the jv3Sector structure.
+//
+// DMK stores raw tracks. See dmk.go.
 
 import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
+	"path"
 	"sort"
+	"strings"
 )
 
 const (
@@ -36,16 +43,15 @@ const (
 	diskHoleWidth = 0.01
 
 	// Speed of disk.
-	diskRpm             = 300
-	clocksPerRevolution = cpuHz * 60 / diskRpm
-
-	// Whether disks are write-protected. We make them all write-protected
-	// since we don't implement writing to disk.
-	writeProtection = true
+	diskRpm = 300
 
 	// Never have more than this many tracks.
 	maxTracks = 255
 
+	// Number of bytes in a raw track, for writing and reading whole tracks.
+	trackSizeSd = 3125 // Single density.
+	trackSizeDd = 6250 // Double density.
+
 	// JV1 info.
 	jv1BytesPerSector  = 256
 	jv1SectorsPerTrack = 10
@@ -79,6 +85,10 @@ const (
 	diskRecType  = 0x60
 	disk1791FB   = 0x00
 	disk1791F8   = 0x20
+	disk1771FB   = 0x00
+	disk1771FA   = 0x20
+	disk1771F9   = 0x40
+	disk1771F8   = 0x60
 )
 
 // Select register bits for writeDiskSelect().
@@ -123,6 +133,8 @@ const (
 	//     c = side compare (0=disable, 1=enable)
 	//     d = select data address mark (writes only, 0 for reads):
 	//         0=FB (normal), 1=F8 (deleted)
+	// On the WD1771 there's no side compare, and for writes cd selects
+	// the data address mark: 00=FB, 01=FA, 10=F9, 11=F8.
 	diskRead   = 0x80 // Single sector
 	diskReadM  = 0x90 // Multiple sectors
 	diskWrite  = 0xa0
@@ -143,9 +155,13 @@ const (
 
 	// Type IV command: cccciiii, where
 	//     cccc = command number
-	//     iiii = bitmask of events to terminate and interrupt on (unused on trs80).
+	//     iiii = bitmask of events to terminate and interrupt on.
 	//            0000 for immediate terminate with no interrupt.
-	diskForceInt = 0xd0
+	diskForceInt    = 0xd0
+	diskIntReady    = 0x01 // Interrupt when the drive goes from not ready to ready.
+	diskIntNotReady = 0x02 // Interrupt when the drive goes from ready to not ready.
+	diskIntIndex    = 0x04 // Interrupt on every index pulse.
+	diskIntNow      = 0x08 // Interrupt immediately.
 )
 
 // JV3 flags and constants.
@@ -166,6 +182,20 @@ const (
 	jv3Free = 0xff // In track/sector fields
 )
 
+// States of the parser for the raw bytes of a Write Track (format) command.
+type formatState int
+
+const (
+	formatGap      = formatState(iota) // Between fields, looking for an address mark.
+	formatTrackId                      // Track number of the ID field.
+	formatSideId                       // Side number of the ID field.
+	formatSectorId                     // Sector number of the ID field.
+	formatSizeId                       // Size code of the ID field.
+	formatIdCrc                        // CRC of the ID field.
+	formatData                         // Bytes of the data field.
+	formatDataCrc                      // CRC of the data field.
+)
+
 // Disk emulation types. After loading a disk file we detect what type of disk
 // it is.
 type emulationType uint
@@ -174,10 +204,11 @@ const (
 	emuNone = emulationType(iota)
 	emuJv1
 	emuJv3
+	emuDmk
 )
 
-// Data about the disk controller. We only emulate the WD1791/93, not the
-// Model I's WD1771.
+// Data about the disk controller. The Model I's WD1771 behaves like the
+// WD1791/93 in single density, except for its data address marks.
 type fdc struct {
 	// Registers.
 	status byte
@@ -193,12 +224,30 @@ type fdc struct {
 	currentDrive   int
 	motorOn        bool
 	motorTimeout   uint64
-	lastReadAdr    int // Id index found by last readadr.
+	lastDirection  int    // Direction of the last step or seek: 1 = in, -1 = out.
+	lastReadAdr    int    // Id index found by last readadr.
+	intConditions  byte   // Events armed by the last Force Interrupt (diskInt*).
+	buffer         []byte // Bytes synthesized for Read Address and Read Track.
+
+	// Write Track (format) state. The ID field is kept until we see the data
+	// address mark that creates the sector.
+	format           formatState
+	formatIdValid    bool // Whether we've seen an ID field without its data yet.
+	formatTrack      byte
+	formatSector     byte
+	formatSizeCode   byte // 0-3 for 128, 256, 512, 1024.
+	formatDataOffset int  // Where in the disk data the sector goes, or -1 to drop it.
+	formatDataLeft   int  // Bytes left in the data field.
 
 	// Disks themselves.
 	disks [driveCount]disk
 }
 
+// A range of bytes in a disk's data, from start up to but not including end.
+type diskRange struct {
+	start, end int
+}
+
 // Data about the floppy that has been inserted.
 type disk struct {
 	// What kind of diskette this is.
@@ -210,11 +259,34 @@ type disk struct {
 	// Where we're pointing to within the data.
 	dataOffset int
 
+	// How far to move dataOffset for each byte read or written. DMK stores
+	// single density bytes twice.
+	dataStep int
+
 	// Nil if no disk is inserted, or the contents of the disk.
 	data []byte
 
+	// File that the data was loaded from and is written back to.
+	filename string
+
+	// Ranges of bytes in data that have been modified but not yet written
+	// back to the file, in order. Only these are written, so that other
+	// changes to the file are left alone.
+	dirty []diskRange
+
+	// Whether the program can't write to the disk. Comes from the image, the
+	// permissions of the file, or the user.
+	writeProtected bool
+
+	// Whether writes are kept in memory (in data and the dirty ranges) instead
+	// of being written to the file.
+	overlay bool
+
 	// JV3-specific data.
 	jv3 jv3
+
+	// DMK-specific data.
+	dmk dmk
 }
 
 // JV3-specific data.
@@ -222,6 +294,7 @@ type jv3 struct {
 	freeId      [4]int                       // The first free id, if any, of each size.
 	lastUsedId  int                          // Id of the last used sector.
 	blockCount  int                          // Number of blocks of ids, 1 or 2.
+	blockOffset [2]int                       // Offset into file of each block of ids.
 	sortedValid bool                         // Whether the sortedId array is valid.
 	id          [jv3SectorsMax + 1]jv3Sector // Extra one is a loop sentinel.
 	offset      [jv3SectorsMax + 1]int       // Offset into file for each id.
@@ -241,6 +314,15 @@ func (id *jv3Sector) makeFree() {
 	id.flags = jv3Free
 }
 
+// Marks the sector as free but keeps its size, so that its space in the file
+// can later be reused by a sector of the same size.
+func (id *jv3Sector) makeFreeKeepingSize() {
+	sizeCode := id.getSizeCode()
+	id.track = jv3Free
+	id.sector = jv3Free
+	id.flags = (jv3Free &^ jv3Size) | (sizeCode ^ 2)
+}
+
 // Fill the three bytes from an array.
 func (id *jv3Sector) fillFromSlice(data []byte) {
 	id.track = data[0]
@@ -251,6 +333,47 @@ func (id *jv3Sector) fillFromSlice(data []byte) {
 	}
 }
 
+// Returns the data address mark that this sector was written with.
+func (id *jv3Sector) dam() byte {
+	if id.doubleDensity() {
+		if id.flags&jv3Dam == jv3DamDdF8 {
+			return 0xF8
+		}
+		return 0xFB
+	}
+
+	switch id.flags & jv3Dam {
+	case jv3DamSdFA:
+		return 0xFA
+	case jv3DamSdF9:
+		return 0xF9
+	case jv3DamSdF8:
+		return 0xF8
+	}
+	return 0xFB
+}
+
+// Returns the flags for a sector with the given data address mark. Double
+// density can only record FB and F8.
+func jv3DamFlags(dam byte, doubleDensity bool) byte {
+	if doubleDensity {
+		if dam == 0xF8 {
+			return jv3DamDdF8
+		}
+		return jv3DamDdFB
+	}
+
+	switch dam {
+	case 0xFA:
+		return jv3DamSdFA
+	case 0xF9:
+		return jv3DamSdF9
+	case 0xF8:
+		return jv3DamSdF8
+	}
+	return jv3DamSdFB
+}
+
 // Returns which side this sector is on.
 func (id *jv3Sector) side() (side side) {
 	side.setFromBoolean(id.flags&jv3Side != 0)
@@ -267,6 +390,12 @@ func (id *jv3Sector) getSize() int {
 	return 128 << id.getSizeCode()
 }
 
+// Return the flags for a used sector with the given size code (0-3 for 128,
+// 256, 512, 1024). The inverse of getSizeCode().
+func jv3SizeFlags(sizeCode byte) byte {
+	return (sizeCode & jv3Size) ^ 1
+}
+
 // Return the size code for this sector: 0-3 for 128, 256, 512, 1024.
 func (id *jv3Sector) getSizeCode() byte {
 	// In used sectors: 0=256,1=128,2=1024,3=512
@@ -307,23 +436,69 @@ func (side *side) setFromBoolean(value bool) {
 	}
 }
 
-// Loads the file from filename into drive.
-func (vm *vm) loadDisk(drive int, filename string) error {
+// Loads the file from filename into drive. If overlay is true, writes to
+// the disk are kept in memory instead of going to the file, until they're
+// committed, discarded, or saved to another file.
+func (vm *vm) loadDisk(drive int, filename string, overlay bool) error {
 	var err error
 
+	disk := &vm.fdc.disks[drive]
 	if filename == "" {
-		err = vm.fdc.disks[drive].makeEmpty()
+		err = disk.makeEmpty()
 	} else {
-		err = vm.fdc.disks[drive].load("disks/" + filename)
+		err = checkDiskFilename(filename)
+		if err == nil {
+			disk.overlay = overlay
+			err = disk.load("disks/" + filename)
+		}
 	}
 
 	return err
 }
 
+// Return an error if the filename (which comes from the UI) isn't in the
+// disks directory or one of its subdirectories.
+func checkDiskFilename(filename string) error {
+	if path.IsAbs(filename) {
+		return fmt.Errorf("Bad disk filename \"%s\"", filename)
+	}
+	for _, element := range strings.Split(filename, "/") {
+		if element == ".." {
+			return fmt.Errorf("Bad disk filename \"%s\"", filename)
+		}
+	}
+
+	return nil
+}
+
+// Save the disk in a drive to a new file in the disks directory, which
+// becomes the disk's file. Existing files aren't overwritten.
+func (vm *vm) saveDiskAs(drive int, filename string) error {
+	disk := &vm.fdc.disks[drive]
+	if disk.data == nil {
+		return fmt.Errorf("No disk in drive %d", drive)
+	}
+
+	// Don't let the user write outside the directory.
+	filename = path.Base(filename)
+	if filename == "" || filename[0] == '.' || filename == "/" {
+		return fmt.Errorf("Bad disk filename \"%s\"", filename)
+	}
+	if path.Ext(filename) == "" {
+		filename += path.Ext(disk.filename)
+	}
+
+	return disk.saveAs("disks/" + filename)
+}
+
 // Empty the drive.
 func (disk *disk) makeEmpty() error {
 	disk.emulationType = emuNone
 	disk.data = nil
+	disk.filename = ""
+	disk.dirty = nil
+	disk.writeProtected = false
+	disk.overlay = false
 	return nil
 }
 
@@ -334,30 +509,148 @@ func (disk *disk) load(filename string) error {
 		return err
 	}
 
-	log.Printf("Loaded disk \"%s\" (%d bytes)", filename, len(data))
 	disk.data = data
+	disk.filename = filename
+	disk.dirty = nil
 
 	// Figure out what kind of disk this is.
-	disk.recognizeDisk()
+	err = disk.recognizeDisk()
+	if err != nil {
+		disk.makeEmpty()
+		return fmt.Errorf("Can't load disk \"%s\": %s", filename, err)
+	}
+	// Overlays don't need to write to the file.
+	disk.writeProtected = disk.imageWriteProtected() || (!disk.overlay && !fileWritable(filename))
+
+	log.Printf("Loaded disk \"%s\" (%d bytes, write-protected = %v, overlay = %v)",
+		filename, len(data), disk.writeProtected, disk.overlay)
 
 	return nil
 }
 
-// Set the emulationType field and fill initial data structures.
-func (disk *disk) recognizeDisk() {
-	// Just recognize type based on the size of the file. The xtrs algorithm
-	// is complex.
-	switch len(disk.data) {
-	case 0:
+// Return whether the image itself says that the disk is write-protected.
+// Only JV3 and DMK have a place for this. Other disks start out protected,
+// so that nothing is written to them until the user takes the tab off.
+func (disk *disk) imageWriteProtected() bool {
+	switch disk.emulationType {
+	case emuJv3:
+		// The byte after the ID block is 0xFF if the disk is writable.
+		return disk.data[jv3SectorStart-1] != 0xFF
+	case emuDmk:
+		return disk.data[dmkWriteProtect] == 0xFF
+	}
+
+	return true
+}
+
+// Return whether we have permission to write to the file.
+func fileWritable(filename string) bool {
+	f, err := os.OpenFile(filename, os.O_WRONLY, 0)
+	if err != nil {
+		return false
+	}
+	f.Close()
+
+	return true
+}
+
+// Put a write-protect tab on the disk or take it off. The setting is saved in
+// the image if the format has a place for it. A disk whose file we can't
+// write to can't be unprotected, unless it's an overlay.
+func (disk *disk) setWriteProtected(writeProtected bool) error {
+	if disk.data == nil {
+		return fmt.Errorf("No disk in drive")
+	}
+
+	writable := disk.overlay || fileWritable(disk.filename)
+	if !writeProtected && !writable {
+		return fmt.Errorf("Can't write to \"%s\"", disk.filename)
+	}
+	disk.writeProtected = writeProtected
+
+	if writable {
+		switch disk.emulationType {
+		case emuJv3:
+			if writeProtected {
+				disk.setByte(jv3SectorStart-1, 0x00)
+			} else {
+				disk.setByte(jv3SectorStart-1, 0xFF)
+			}
+		case emuDmk:
+			if writeProtected {
+				disk.setByte(dmkWriteProtect, 0xFF)
+			} else {
+				disk.setByte(dmkWriteProtect, 0x00)
+			}
+		}
+		return disk.flush()
+	}
+
+	return nil
+}
+
+// Set the emulationType field and fill initial data structures. Like xtrs,
+// we look at the contents rather than trusting the size or the filename:
+// first for a DMK header, then for a sensible JV3 ID block, and finally for
+// a whole number of JV1 tracks. Returns an error if nothing fits.
+func (disk *disk) recognizeDisk() error {
+	if len(disk.data) == 0 {
 		disk.emulationType = emuNone
-	case 89600:
-		disk.emulationType = emuJv1
-	case 193024, 377344:
+		return nil
+	}
+
+	dmkErr := disk.loadDmkData()
+	if dmkErr == nil {
+		disk.emulationType = emuDmk
+		return nil
+	}
+
+	jv3Err := checkJv3Data(disk.data)
+	if jv3Err == nil {
 		disk.emulationType = emuJv3
 		disk.loadJv3Data()
-	default:
-		log.Fatalf("Don't know format of %d-byte disk", len(disk.data))
+		return nil
+	}
+
+	jv1TrackSize := jv1SectorsPerTrack * jv1BytesPerSector
+	if len(disk.data)%jv1TrackSize == 0 && len(disk.data)/jv1TrackSize <= maxTracks {
+		disk.emulationType = emuJv1
+		return nil
+	}
+
+	return fmt.Errorf("Unknown format of %d-byte disk (not DMK: %s; not JV3: %s; not JV1: %d bytes isn't a multiple of %d)",
+		len(disk.data), dmkErr, jv3Err, len(disk.data), jv1TrackSize)
+}
+
+// Check that data looks like a JV3 file. The sectors of the used entries in
+// each ID block must fit in the file. Other formats interpreted as IDs look
+// like thousands of used sectors.
+func checkJv3Data(data []byte) error {
+	if len(data) < jv3SectorStart {
+		return fmt.Errorf("file is shorter than the ID block")
+	}
+
+	blockStart := jv3IdStart
+	for block := 0; block < 2 && blockStart+3*jv3SectorsPerBlock <= len(data); block++ {
+		offset := blockStart + jv3SectorStart
+		end := offset
+		for i := 0; i < jv3SectorsPerBlock; i++ {
+			var id jv3Sector
+			id.fillFromSlice(data[blockStart+3*i:])
+			if id.track != jv3Free {
+				end = offset + id.getSize()
+			}
+			offset += id.getSize()
+		}
+		if end > len(data) {
+			return fmt.Errorf("sectors need %d bytes but file has %d", end, len(data))
+		}
+
+		// The next block, if any, follows the space for all the sectors.
+		blockStart = offset
 	}
+
+	return nil
 }
 
 // Loads JV3-specific data from the file and creates the in-memory data structures.
@@ -378,23 +671,28 @@ func (disk *disk) loadJv3Data() {
 
 	// We pre-compute some information about used and free sectors that we'll
 	// use later when writing.
+	disk.jv3.updateFreeIds()
+
+	// Sort the IDs for fast lookup.
+	disk.jv3.sortIds()
+}
+
+// Recompute the first free id of each size and the last used id.
+func (jv3 *jv3) updateFreeIds() {
 	for i := 0; i < 4; i++ {
-		disk.jv3.freeId[i] = jv3SectorsMax
+		jv3.freeId[i] = jv3SectorsMax
 	}
-	disk.jv3.lastUsedId = -1
+	jv3.lastUsedId = -1
 	for idIndex := 0; idIndex < jv3SectorsMax; idIndex++ {
-		if disk.jv3.id[idIndex].track == jv3Free {
-			sizeCode := disk.jv3.id[idIndex].getSizeCode()
-			if disk.jv3.freeId[sizeCode] == jv3SectorsMax {
-				disk.jv3.freeId[sizeCode] = idIndex
+		if jv3.id[idIndex].track == jv3Free {
+			sizeCode := jv3.id[idIndex].getSizeCode()
+			if jv3.freeId[sizeCode] == jv3SectorsMax {
+				jv3.freeId[sizeCode] = idIndex
 			}
 		} else {
-			disk.jv3.lastUsedId = idIndex
+			jv3.lastUsedId = idIndex
 		}
 	}
-
-	// Sort the IDs for fast lookup.
-	disk.jv3.sortIds()
 }
 
 // Load one of the blocks of sector infos in JV3 disks. Return the byte
@@ -402,6 +700,7 @@ func (disk *disk) loadJv3Data() {
 func (disk *disk) loadJv3Block(idStart, blockStart int) int {
 	// Make sure there's enough there to read.
 	if blockStart+3*jv3SectorsPerBlock <= len(disk.data) {
+		disk.jv3.blockOffset[disk.jv3.blockCount] = blockStart
 		disk.jv3.blockCount++
 
 		// Read the block into the sector info.
@@ -411,15 +710,8 @@ func (disk *disk) loadJv3Block(idStart, blockStart int) int {
 			start += 3
 		}
 
-		// Compute offsets of each sector.
-		offset := blockStart + jv3SectorStart
-		for i := 0; i < jv3SectorsPerBlock; i++ {
-			disk.jv3.offset[idStart+i] = offset
-			offset += disk.jv3.id[idStart+i].getSize()
-		}
-
 		// Where next block would begin.
-		return offset
+		return disk.jv3.computeOffsets(idStart / jv3SectorsPerBlock)
 	}
 
 	// Doesn't matter here, this would only happen for the second block, and
@@ -427,6 +719,213 @@ func (disk *disk) loadJv3Block(idStart, blockStart int) int {
 	return 0
 }
 
+// Compute the offsets of each sector described by a block. Return the byte
+// offset of the end of the sectors.
+func (jv3 *jv3) computeOffsets(block int) int {
+	idStart := block * jv3SectorsPerBlock
+	offset := jv3.blockOffset[block] + jv3SectorStart
+	for i := 0; i < jv3SectorsPerBlock; i++ {
+		jv3.offset[idStart+i] = offset
+		offset += jv3.id[idStart+i].getSize()
+	}
+
+	return offset
+}
+
+// Free all the sectors on a track and side, for example before formatting it.
+func (disk *disk) freeJv3Track(track byte, side side) {
+	for idIndex := 0; idIndex <= disk.jv3.lastUsedId; idIndex++ {
+		id := &disk.jv3.id[idIndex]
+		if id.track == track && id.side() == side {
+			id.makeFreeKeepingSize()
+			disk.writeJv3Id(idIndex)
+		}
+	}
+
+	disk.jv3.updateFreeIds()
+	disk.jv3.sortedValid = false
+}
+
+// Add a new sector to the disk. We reuse the space of a free sector of the
+// same size if there is one, and otherwise append it after the last used
+// sector, adding the second block of ids if necessary. Returns the index of
+// the new id, or -1 if the disk is full.
+func (disk *disk) addJv3Sector(newId jv3Sector) int {
+	jv3 := &disk.jv3
+	sizeCode := newId.getSizeCode()
+
+	idIndex := jv3.freeId[sizeCode]
+	if idIndex > jv3.lastUsedId {
+		// No free sector of this size among the used ones. Append.
+		idIndex = jv3.lastUsedId + 1
+		if idIndex >= jv3SectorsMax {
+			return -1
+		}
+		block := idIndex / jv3SectorsPerBlock
+
+		// Changing the size of this sector moves all the sectors after it.
+		// We can't do that if there's another block of ids after them.
+		if block+1 < jv3.blockCount && jv3.id[idIndex].getSize() != newId.getSize() {
+			return -1
+		}
+
+		if block == jv3.blockCount {
+			// Start the second block right after the sectors of the first.
+			blockStart := jv3.computeOffsets(block - 1)
+			for i := 0; i < jv3SectorStart; i++ {
+				disk.setByte(blockStart+i, jv3Free)
+			}
+			jv3.blockOffset[block] = blockStart
+			jv3.blockCount++
+		}
+
+		jv3.id[idIndex] = newId
+		jv3.computeOffsets(block)
+	} else {
+		jv3.id[idIndex] = newId
+	}
+
+	disk.writeJv3Id(idIndex)
+	jv3.updateFreeIds()
+	jv3.sortedValid = false
+
+	return idIndex
+}
+
+// Return the byte offset in the file of the three-byte sector info for the
+// given id.
+func (jv3 *jv3) idOffset(index int) int {
+	block := index / jv3SectorsPerBlock
+	return jv3.blockOffset[block] + 3*(index%jv3SectorsPerBlock)
+}
+
+// Write the sector info for the given id back into the disk data.
+func (disk *disk) writeJv3Id(index int) {
+	id := &disk.jv3.id[index]
+	offset := disk.jv3.idOffset(index)
+	disk.setByte(offset, id.track)
+	disk.setByte(offset+1, id.sector)
+	disk.setByte(offset+2, id.flags)
+}
+
+// Store a byte into the disk data, growing the data if necessary. The byte
+// will be written to the file at the next flush().
+func (disk *disk) setByte(offset int, value byte) {
+	if offset >= len(disk.data) {
+		disk.data = append(disk.data, make([]byte, offset+1-len(disk.data))...)
+	}
+	disk.data[offset] = value
+
+	disk.markDirty(offset)
+}
+
+// Add the byte at offset to the dirty ranges, joining ranges that touch.
+func (disk *disk) markDirty(offset int) {
+	ranges := disk.dirty
+
+	// First range that ends at or after the byte.
+	i := sort.Search(len(ranges), func(i int) bool { return ranges[i].end >= offset })
+
+	switch {
+	case i < len(ranges) && ranges[i].start <= offset:
+		// In the range, or just after it.
+		if offset == ranges[i].end {
+			ranges[i].end++
+			if i+1 < len(ranges) && ranges[i+1].start == ranges[i].end {
+				ranges[i].end = ranges[i+1].end
+				disk.dirty = append(ranges[:i+1], ranges[i+2:]...)
+			}
+		}
+	case i < len(ranges) && ranges[i].start == offset+1:
+		// Just before the range.
+		ranges[i].start--
+	default:
+		// New range before range i.
+		disk.dirty = append(ranges, diskRange{})
+		copy(disk.dirty[i+1:], disk.dirty[i:])
+		disk.dirty[i] = diskRange{offset, offset + 1}
+	}
+}
+
+// Store a byte at dataOffset and move past it, writing it twice if the format
+// doubles bytes at this density.
+func (disk *disk) putDataByte(value byte) {
+	for i := 0; i < disk.dataStep; i++ {
+		disk.setByte(disk.dataOffset, value)
+		disk.dataOffset++
+	}
+}
+
+// Write the modified parts of the disk data back to the file. Overlays keep
+// them until they're committed.
+func (disk *disk) flush() error {
+	if disk.overlay {
+		return nil
+	}
+
+	return disk.commit()
+}
+
+// Write the modified parts of the disk data back to the file, even if the
+// disk is an overlay.
+func (disk *disk) commit() error {
+	if len(disk.dirty) == 0 {
+		// Nothing to write.
+		return nil
+	}
+
+	f, err := os.OpenFile(disk.filename, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for _, r := range disk.dirty {
+		_, err = f.WriteAt(disk.data[r.start:r.end], int64(r.start))
+		if err != nil {
+			return err
+		}
+
+		if diskDebug {
+			log.Printf("Wrote bytes %d to %d of \"%s\"", r.start, r.end, disk.filename)
+		}
+	}
+
+	disk.dirty = nil
+
+	return nil
+}
+
+// Forget the changes made to an overlay by reloading its file.
+func (disk *disk) discard() error {
+	if disk.data == nil {
+		return fmt.Errorf("No disk in drive")
+	}
+
+	return disk.load(disk.filename)
+}
+
+// Write the whole disk to a new file, which becomes the disk's file. Fails if
+// the file already exists.
+func (disk *disk) saveAs(filename string) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(disk.data)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Saved disk \"%s\" as \"%s\"", disk.filename, filename)
+	disk.filename = filename
+	disk.dirty = nil
+
+	return nil
+}
+
 // Initialize the FDC.
 func (vm *vm) diskInit(powerOn bool) {
 	fdc := &vm.fdc
@@ -449,6 +948,8 @@ func (vm *vm) diskInit(powerOn bool) {
 	fdc.currentDrive = 0
 	fdc.motorOn = false
 	fdc.motorTimeout = 0
+	fdc.lastDirection = 1
+	fdc.intConditions = 0
 	vm.fdc.lastReadAdr = -1
 
 	for i := 0; i < len(fdc.disks); i++ {
@@ -507,7 +1008,7 @@ func (vm *vm) diskFirstDrq(bits byte) {
 	currentCommand := vm.fdc.currentCommand
 	// If we've not finished our work within half a second, trigger a lost data
 	// interrupt.
-	vm.addEvent(eventDiskLostData, func() { vm.diskLostData(currentCommand) }, cpuHz/2)
+	vm.addEvent(eventDiskLostData, func() { vm.diskLostData(currentCommand) }, vm.cpuHz()/2)
 }
 
 // If we've not used this drive within the timeout period, shut off the motor. Returns
@@ -515,8 +1016,10 @@ func (vm *vm) diskFirstDrq(bits byte) {
 func (vm *vm) checkDiskMotorOff() bool {
 	stopped := vm.clock > vm.fdc.motorTimeout
 	if stopped {
+		wasReady := vm.fdc.status&diskNotRdy == 0
 		vm.setDiskMotor(false)
 		vm.fdc.status |= diskNotRdy
+		vm.checkDiskReadyInterrupt(wasReady)
 
 		// See if we were in the middle of doing something.
 		if isReadWriteCommand(vm.fdc.currentCommand) && (vm.fdc.status&diskDrq) != 0 {
@@ -542,9 +1045,48 @@ func (vm *vm) setDiskMotor(motorOn bool) {
 // on the hole itself.
 func (vm *vm) diskAngle() float32 {
 	// Use simulated time.
+	clocksPerRevolution := vm.clocksPerRevolution()
 	return float32(vm.clock%clocksPerRevolution) / float32(clocksPerRevolution)
 }
 
+// Number of clock cycles for the disk to turn once.
+func (vm *vm) clocksPerRevolution() uint64 {
+	return vm.cpuHz() * 60 / diskRpm
+}
+
+// Schedule an event for the next time the leading edge of the index hole
+// passes under the head.
+func (vm *vm) scheduleDiskIndex() {
+	clocksPerRevolution := vm.clocksPerRevolution()
+	delay := clocksPerRevolution - vm.clock%clocksPerRevolution
+	vm.addEvent(eventDiskIndex, func() { vm.diskIndex() }, delay)
+}
+
+// Event for the index pulse, used when a Force Interrupt command asked to be
+// interrupted on every index pulse.
+func (vm *vm) diskIndex() {
+	disk := &vm.fdc.disks[vm.fdc.currentDrive]
+
+	// There's no pulse if the disk isn't turning.
+	if vm.fdc.motorOn && disk.data != nil {
+		vm.diskIntrqInterrupt(true)
+	}
+
+	vm.scheduleDiskIndex()
+}
+
+// Interrupt if the drive became ready or not ready and the last Force
+// Interrupt command asked for that.
+func (vm *vm) checkDiskReadyInterrupt(wasReady bool) {
+	isReady := vm.fdc.status&diskNotRdy == 0
+
+	if (!wasReady && isReady && vm.fdc.intConditions&diskIntReady != 0) ||
+		(wasReady && !isReady && vm.fdc.intConditions&diskIntNotReady != 0) {
+
+		vm.diskIntrqInterrupt(true)
+	}
+}
+
 // Whether the current disk command is read or write (as opposed to seek, etc.).
 func isReadWriteCommand(cmd byte) bool {
 	cmdType := commandType(cmd)
@@ -590,8 +1132,8 @@ func (vm *vm) updateDiskStatus() {
 			vm.fdc.status &^= diskIndex
 		}
 
-		// We're always write-protected.
-		if writeProtection {
+		// Write-protect tab.
+		if disk.writeProtected {
 			vm.fdc.status |= diskWritePrt
 		} else {
 			vm.fdc.status &^= diskWritePrt
@@ -629,6 +1171,7 @@ func (vm *vm) readDiskStatus() byte {
 		if vm.clock > vm.fdc.motorTimeout {
 			vm.setDiskMotor(false)
 			vm.fdc.status |= diskNotRdy
+			vm.checkDiskReadyInterrupt(true)
 		}
 	}
 
@@ -666,8 +1209,9 @@ func (vm *vm) readDiskData() byte {
 
 	// The read command can do various things depending on the specific current command,
 	// but we only support reading from the diskette.
-	switch vm.fdc.currentCommand & diskCommandMask {
-	case diskRead:
+	cmd := vm.fdc.currentCommand
+	switch cmd & diskCommandMask {
+	case diskRead, diskReadM:
 		// Keep reading from the buffer.
 		if vm.fdc.byteCount > 0 && (vm.fdc.status&diskDrq) != 0 {
 			var c byte
@@ -679,7 +1223,7 @@ func (vm *vm) readDiskData() byte {
 				}
 			} else {
 				c = disk.data[disk.dataOffset]
-				disk.dataOffset++
+				disk.dataOffset += disk.dataStep
 			}
 			vm.fdc.data = c
 			vm.fdc.byteCount--
@@ -688,13 +1232,38 @@ func (vm *vm) readDiskData() byte {
 				vm.fdc.status &^= diskDrq
 				vm.diskDrqInterrupt(false)
 				vm.events.cancelEvents(eventDiskLostData)
+				if cmd&diskMMask != 0 {
+					// Move on to the next sector. We stop with Record
+					// Not Found when we run off the end of the track.
+					vm.fdc.sector++
+					vm.addEvent(eventDiskFirstDrq, func() { vm.diskStartRead(cmd) }, 64)
+				} else {
+					vm.addEvent(eventDiskDone, func() { vm.diskDone(0) }, 64)
+				}
+			}
+		}
+
+	case diskReadAdr, diskReadTrk:
+		// Keep reading from the synthesized bytes.
+		if vm.fdc.byteCount > 0 && (vm.fdc.status&diskDrq) != 0 {
+			vm.fdc.data = vm.fdc.buffer[len(vm.fdc.buffer)-vm.fdc.byteCount]
+			vm.fdc.byteCount--
+			if vm.fdc.byteCount <= 0 {
+				vm.fdc.byteCount = 0
+				vm.fdc.status &^= diskDrq
+				vm.diskDrqInterrupt(false)
+				vm.events.cancelEvents(eventDiskLostData)
+				if vm.fdc.currentCommand&diskCommandMask == diskReadAdr {
+					// The 179x copies the track number into the sector register.
+					vm.fdc.sector = vm.fdc.buffer[0]
+				}
 				vm.addEvent(eventDiskDone, func() { vm.diskDone(0) }, 64)
 			}
 		}
 
 	default:
-		// Might be okay, not sure.
-		panic("Unhandled case in readDiskData()")
+		// Other commands, such as a Force Interrupt that ended a multiple
+		// sector read, leave the last byte in the data register.
 	}
 
 	if diskDebug {
@@ -719,12 +1288,18 @@ func (vm *vm) writeDiskCommand(cmd byte) {
 	vm.fdc.byteCount = 0
 	vm.fdc.currentCommand = cmd
 
+	// Any new command disarms the conditions of the last Force Interrupt.
+	vm.fdc.intConditions = 0
+	vm.events.cancelEvents(eventDiskIndex)
+
 	// Kick off anything that's based on the command.
 	switch cmd & diskCommandMask {
 	case diskRestore:
 		vm.fdc.lastReadAdr = -1
 		disk.physicalTrack = 0
 		vm.fdc.track = 0
+		// The head stepped out to get here.
+		vm.fdc.lastDirection = -1
 		vm.fdc.status = diskTrkZero | diskBusy
 		if cmd&diskVMask != 0 {
 			vm.diskVerify()
@@ -732,127 +1307,488 @@ func (vm *vm) writeDiskCommand(cmd byte) {
 		vm.addEvent(eventDiskDone, func() { vm.diskDone(0) }, 2000)
 	case diskSeek:
 		vm.fdc.lastReadAdr = -1
-		disk.physicalTrack += vm.fdc.data - vm.fdc.track
+		delta := int(vm.fdc.data) - int(vm.fdc.track)
+		if delta > 0 {
+			vm.fdc.lastDirection = 1
+		} else if delta < 0 {
+			vm.fdc.lastDirection = -1
+		}
+		disk.moveHead(delta)
 		vm.fdc.track = vm.fdc.data
-		if disk.physicalTrack <= 0 {
-			// vm.fdc.track too?
-			disk.physicalTrack = 0
+		if disk.physicalTrack == 0 {
 			vm.fdc.status = diskTrkZero | diskBusy
 		} else {
 			vm.fdc.status = diskBusy
 		}
-		// Should this set lastDirection?
 		if cmd&diskVMask != 0 {
 			vm.diskVerify()
 		}
 		vm.addEvent(eventDiskDone, func() { vm.diskDone(0) }, 2000)
-	case diskStep:
-		panic("Don't handle diskStep")
-	case diskStepU:
-		panic("Don't handle diskStepU")
-	case diskStepIn:
-		panic("Don't handle diskStepIn")
-	case diskStepInU:
-		panic("Don't handle diskStepInU")
-	case diskStepOut:
-		panic("Don't handle diskStepOut")
-	case diskStepOutU:
-		panic("Don't handle diskStepOutU")
-	case diskRead:
-		// Read the sector. The bytes will be read later.
+	case diskStep, diskStepU:
+		// Same direction as last time.
+		vm.diskStep(cmd, vm.fdc.lastDirection)
+	case diskStepIn, diskStepInU:
+		vm.diskStep(cmd, 1)
+	case diskStepOut, diskStepOutU:
+		vm.diskStep(cmd, -1)
+	case diskRead, diskReadM:
+		// Find the sector. The bytes will be read later.
 		vm.fdc.lastReadAdr = -1
 		vm.fdc.status = 0
-		goalSide := side(-1)
-		if cmd&diskCMask != 0 {
-			goalSide.setFromBoolean((cmd & diskBMask) != 0)
+		vm.diskStartRead(cmd)
+	case diskWrite, diskWriteM:
+		// Find the sector. The bytes will be written later.
+		vm.fdc.lastReadAdr = -1
+		vm.fdc.status = 0
+		if disk.writeProtected {
+			vm.fdc.status = diskWritePrt
+			vm.addEvent(eventDiskDone, func() { vm.diskDone(0) }, 512)
+		} else {
+			vm.diskStartWrite(cmd)
 		}
-
-		// Look for the sector in the file.
-		sectorIndex := vm.searchSector(int(vm.fdc.sector), goalSide)
+	case diskReadAdr:
+		// Read the ID field of the next sector to go under the head.
+		vm.fdc.status = 0
+		sectorIndex := vm.searchAddress()
 		if sectorIndex == -1 {
 			vm.fdc.status |= diskBusy
 			vm.addEvent(eventDiskDone, func() { vm.diskDone(0) }, 512)
-			log.Printf("Didn't find sector %02X on track %02X",
-				vm.fdc.sector, disk.physicalTrack)
 		} else {
-			var newStatus byte = 0
-			switch disk.emulationType {
-			case emuJv1:
-				if disk.physicalTrack == jv1DirectoryTrack {
-					newStatus = disk1791F8
-				}
-				vm.fdc.byteCount = jv1BytesPerSector
-				disk.dataOffset = disk.getDataOffset(sectorIndex)
-			case emuJv3:
-				if !vm.fdc.doubleDensity {
-					// Single density 179x.
-					switch disk.jv3.id[sectorIndex].flags & jv3Dam {
-					case jv3DamSdFB:
-						newStatus = disk1791FB
-						break
-					case jv3DamSdFA:
-						newStatus = disk1791F8
-						break
-					case jv3DamSdF9:
-						newStatus = disk1791F8
-						break
-					case jv3DamSdF8:
-						newStatus = disk1791F8
-						break
-					}
-				} else {
-					// Double density 179x.
-					switch disk.jv3.id[sectorIndex].flags & jv3Dam {
-					default: /*impossible*/
-					case jv3DamDdFB:
-						newStatus = disk1791FB
-						break
-					case jv3DamDdF8:
-						newStatus = disk1791F8
-						break
-					}
-				}
-				if disk.jv3.id[sectorIndex].flags&jv3Error != 0 {
-					newStatus |= diskCrcErr
-				}
-				vm.fdc.byteCount = disk.jv3.id[sectorIndex].getSize()
-				disk.dataOffset = disk.getDataOffset(sectorIndex)
-			default:
-				panic("Unhandled case in diskRead")
-			}
+			vm.fdc.lastReadAdr = sectorIndex
+			vm.fdc.buffer = disk.idField(sectorIndex, vm.fdc.doubleDensity)
+			vm.fdc.byteCount = len(vm.fdc.buffer)
 			vm.fdc.status |= diskBusy
-			vm.addEvent(eventDiskFirstDrq, func() { vm.diskFirstDrq(newStatus) }, 64)
-		}
-	case diskReadM:
-		panic("Don't handle diskReadM")
-	case diskWrite:
-		panic("Don't handle diskWrite")
-	case diskWriteM:
-		panic("Don't handle diskWriteM")
-	case diskReadAdr:
-		panic("Don't handle diskReadAdr")
+			vm.addEvent(eventDiskFirstDrq, func() { vm.diskFirstDrq(0) }, 64)
+		}
 	case diskReadTrk:
-		panic("Don't handle diskReadTrk")
+		// Read the whole raw track, starting at the index hole.
+		vm.fdc.lastReadAdr = -1
+		vm.fdc.status = 0
+		if disk.data == nil {
+			vm.fdc.status |= diskBusy
+			vm.addEvent(eventDiskDone, func() { vm.diskDone(0) }, 512)
+		} else {
+			vm.fdc.buffer = vm.diskTrackImage()
+			vm.fdc.byteCount = len(vm.fdc.buffer)
+			vm.fdc.status |= diskBusy
+			vm.addEvent(eventDiskFirstDrq, func() { vm.diskFirstDrq(0) }, 64)
+		}
 	case diskWriteTrk:
-		panic("Don't handle diskWriteTrk")
+		// Format the track. The bytes will be written later.
+		vm.fdc.lastReadAdr = -1
+		vm.fdc.status = 0
+		if disk.writeProtected || disk.data == nil {
+			vm.fdc.status = diskWritePrt
+			vm.addEvent(eventDiskDone, func() { vm.diskDone(0) }, 512)
+		} else {
+			vm.diskStartWriteTrack()
+		}
 	case diskForceInt:
-		// Stop whatever is going on and forget it.
+		// Stop whatever is going on and forget it. The drive stays
+		// not ready if it was.
 		vm.events.cancelEvents(eventDisk)
-		vm.fdc.status = 0
+		vm.fdc.status &= diskNotRdy
 		vm.updateDiskStatus()
-		if (cmd & 0x07) != 0 {
-			panic("Conditional interrupt features not implemented")
-		} else if (cmd & 0x08) != 0 {
+		if cmd&diskIntNow != 0 {
 			// Immediate interrupt.
 			vm.diskIntrqInterrupt(true)
 		} else {
 			vm.diskIntrqInterrupt(false)
 		}
+
+		// Interrupt later on these conditions, until the next command.
+		vm.fdc.intConditions = cmd & (diskIntReady | diskIntNotReady | diskIntIndex)
+		if vm.fdc.intConditions&diskIntIndex != 0 {
+			vm.scheduleDiskIndex()
+		}
 	default:
 		panic(fmt.Sprintf("Unknown disk command %02X", cmd))
 	}
 }
 
+// Step the head one track in the given direction, 1 for in (towards higher
+// tracks) and -1 for out. The track register is only updated if the command
+// has the U bit set.
+func (vm *vm) diskStep(cmd byte, direction int) {
+	disk := &vm.fdc.disks[vm.fdc.currentDrive]
+
+	vm.fdc.lastReadAdr = -1
+	vm.fdc.lastDirection = direction
+	disk.moveHead(direction)
+	if cmd&diskUMask != 0 {
+		vm.fdc.track += byte(direction)
+	}
+	if disk.physicalTrack == 0 {
+		vm.fdc.status = diskTrkZero | diskBusy
+	} else {
+		vm.fdc.status = diskBusy
+	}
+	if cmd&diskVMask != 0 {
+		vm.diskVerify()
+	}
+	vm.addEvent(eventDiskDone, func() { vm.diskDone(0) }, 2000)
+}
+
+// Move the head by delta tracks. The head stops at track 0 and at the last
+// track that we support.
+func (disk *disk) moveHead(delta int) {
+	track := int(disk.physicalTrack) + delta
+	if track < 0 {
+		track = 0
+	} else if track >= maxTracks {
+		track = maxTracks - 1
+	}
+	disk.physicalTrack = byte(track)
+}
+
+// Returns the side that a type II command should compare against the sector
+// ID, or -1 if the command doesn't ask for a side compare.
+func (vm *vm) commandSide(cmd byte) side {
+	goalSide := side(-1)
+	if cmd&diskCMask != 0 && vm.machine.model != model1 {
+		goalSide.setFromBoolean((cmd & diskBMask) != 0)
+	}
+
+	return goalSide
+}
+
+// Returns the data address mark that a write command asks for.
+func (vm *vm) commandDam(cmd byte) byte {
+	if vm.machine.model == model1 {
+		// FB, FA, F9, or F8.
+		return 0xFB - cmd&(diskCMask|diskDMask)
+	}
+	if cmd&diskDMask != 0 {
+		return 0xF8
+	}
+
+	return 0xFB
+}
+
+// Returns the read status bits for a sector with the given data address mark.
+// The WD1791 reports anything but FB as deleted.
+func (vm *vm) damStatus(dam byte) byte {
+	if vm.machine.model == model1 {
+		switch dam {
+		case 0xFA:
+			return disk1771FA
+		case 0xF9:
+			return disk1771F9
+		case 0xF8:
+			return disk1771F8
+		}
+		return disk1771FB
+	}
+
+	if dam == 0xFB {
+		return disk1791FB
+	}
+	return disk1791F8
+}
+
+// Returns the data address mark that the directory track of a JV1 disk is
+// read with. Model I DOSes write the directory with FA, which the WD1791
+// reads as deleted.
+func (vm *vm) jv1DirectoryDam() byte {
+	if vm.machine.model == model1 {
+		return 0xFA
+	}
+
+	return 0xF8
+}
+
+// Look for the sector in the sector register and get ready to send its
+// bytes through readDiskData(). Used for both single and multiple sector
+// reads.
+func (vm *vm) diskStartRead(cmd byte) {
+	disk := &vm.fdc.disks[vm.fdc.currentDrive]
+
+	// Forget the record type of the previous sector of a multiple sector read.
+	vm.fdc.status &^= diskRecType | diskCrcErr
+
+	// Look for the sector in the file.
+	sectorIndex := vm.searchSector(int(vm.fdc.sector), vm.commandSide(cmd))
+	if sectorIndex == -1 {
+		vm.fdc.status |= diskBusy
+		vm.addEvent(eventDiskDone, func() { vm.diskDone(0) }, 512)
+		// Multiple sector reads normally end this way, so only log
+		// single sector misses.
+		if cmd&diskMMask == 0 {
+			log.Printf("Didn't find sector %02X on track %02X",
+				vm.fdc.sector, disk.physicalTrack)
+		}
+	} else {
+		var newStatus byte = 0
+		disk.dataStep = 1
+		switch disk.emulationType {
+		case emuJv1:
+			if disk.physicalTrack == jv1DirectoryTrack {
+				newStatus = vm.damStatus(vm.jv1DirectoryDam())
+			}
+			vm.fdc.byteCount = jv1BytesPerSector
+			disk.dataOffset = disk.getDataOffset(sectorIndex)
+		case emuJv3:
+			newStatus = vm.damStatus(disk.jv3.id[sectorIndex].dam())
+			if disk.jv3.id[sectorIndex].flags&jv3Error != 0 {
+				newStatus |= diskCrcErr
+			}
+			vm.fdc.byteCount = disk.jv3.id[sectorIndex].getSize()
+			disk.dataOffset = disk.getDataOffset(sectorIndex)
+		case emuDmk:
+			doubleDensity := vm.fdc.doubleDensity
+			dam := disk.dmkDataAddressMark(sectorIndex, doubleDensity)
+			if dam == -1 {
+				// ID field without a data field.
+				vm.fdc.status |= diskBusy | diskNotFound
+				vm.addEvent(eventDiskDone, func() { vm.diskDone(0) }, 512)
+				return
+			}
+			newStatus = vm.damStatus(disk.data[dam])
+			size := 128 << (disk.dmkIdField(sectorIndex, doubleDensity)[3] & 0x03)
+			if disk.dmkCrcError(sectorIndex, dam, size, doubleDensity) {
+				newStatus |= diskCrcErr
+			}
+			vm.fdc.byteCount = size
+			disk.dataStep = disk.dmk.byteStep(doubleDensity)
+			disk.dataOffset = disk.getDataOffset(sectorIndex)
+		default:
+			panic("Unhandled case in diskStartRead()")
+		}
+		vm.fdc.status |= diskBusy
+		vm.addEvent(eventDiskFirstDrq, func() { vm.diskFirstDrq(newStatus) }, 64)
+	}
+}
+
+// Look for the sector in the sector register and get ready to receive its
+// bytes through writeDiskData(). Used for both single and multiple sector
+// writes.
+func (vm *vm) diskStartWrite(cmd byte) {
+	disk := &vm.fdc.disks[vm.fdc.currentDrive]
+
+	sectorIndex := vm.searchSector(int(vm.fdc.sector), vm.commandSide(cmd))
+	if sectorIndex == -1 {
+		vm.fdc.status |= diskBusy
+		vm.addEvent(eventDiskDone, func() { vm.diskDone(0) }, 512)
+		// Multiple sector writes normally end this way, so only log
+		// single sector misses.
+		if cmd&diskMMask == 0 {
+			log.Printf("Didn't find sector %02X on track %02X",
+				vm.fdc.sector, disk.physicalTrack)
+		}
+		return
+	}
+
+	dam := vm.commandDam(cmd)
+
+	disk.dataStep = 1
+	switch disk.emulationType {
+	case emuJv1:
+		// JV1 has nowhere to store the data address mark. The directory
+		// track is always read as deleted and the others as FB.
+		if (dam != 0xFB) != (disk.physicalTrack == jv1DirectoryTrack) {
+			log.Printf("Can't write data address mark %02X on JV1 track %d",
+				dam, disk.physicalTrack)
+		}
+		vm.fdc.byteCount = jv1BytesPerSector
+		disk.dataOffset = disk.getDataOffset(sectorIndex)
+	case emuJv3:
+		id := &disk.jv3.id[sectorIndex]
+
+		// Record the new data address mark and clear any CRC error.
+		id.flags = (id.flags &^ (jv3Dam | jv3Error)) | jv3DamFlags(dam, vm.fdc.doubleDensity)
+		disk.writeJv3Id(sectorIndex)
+		vm.fdc.byteCount = id.getSize()
+		disk.dataOffset = disk.getDataOffset(sectorIndex)
+	case emuDmk:
+		// Write the data address mark, and the sync bytes before it if the
+		// sector was formatted without a data field. The CRC is written
+		// after the data.
+		doubleDensity := vm.fdc.doubleDensity
+		disk.dataStep = disk.dmk.byteStep(doubleDensity)
+		size := 128 << (disk.dmkIdField(sectorIndex, doubleDensity)[3] & 0x03)
+		damOffset := disk.dmkDataAddressMark(sectorIndex, doubleDensity)
+		newDam := damOffset == -1
+		if newDam {
+			damOffset = disk.dmkNewDataAddressMark(sectorIndex, doubleDensity)
+		}
+
+		// Don't let the mark, data, and CRC run into the next track.
+		if damOffset+(1+size+2)*disk.dataStep > disk.dmk.trackEnd(sectorIndex) {
+			log.Printf("Sector %02X doesn't fit on DMK track %02X",
+				vm.fdc.sector, disk.physicalTrack)
+			vm.fdc.status |= diskBusy | diskNotFound
+			vm.addEvent(eventDiskDone, func() { vm.diskDone(0) }, 512)
+			return
+		}
+
+		if newDam {
+			disk.writeDmkDataSync(sectorIndex, doubleDensity)
+		}
+		disk.dmk.damOffset = damOffset
+		disk.dataOffset = damOffset
+		disk.putDataByte(dam)
+		vm.fdc.byteCount = size
+	default:
+		panic("Unhandled case in diskStartWrite()")
+	}
+
+	vm.fdc.status |= diskBusy
+	vm.addEvent(eventDiskFirstDrq, func() { vm.diskFirstDrq(0) }, 64)
+}
+
+// Get ready to receive the raw bytes of a track through writeDiskData().
+func (vm *vm) diskStartWriteTrack() {
+	disk := &vm.fdc.disks[vm.fdc.currentDrive]
+
+	// The old sectors are erased by the new ones.
+	switch disk.emulationType {
+	case emuJv3:
+		disk.freeJv3Track(disk.physicalTrack, vm.fdc.side)
+	case emuDmk:
+		if !disk.dmkStartWriteTrack(disk.physicalTrack, vm.fdc.side) {
+			vm.fdc.status = diskWritePrt
+			vm.addEvent(eventDiskDone, func() { vm.diskDone(0) }, 512)
+			return
+		}
+	}
+
+	vm.fdc.format = formatGap
+	vm.fdc.formatIdValid = false
+	if vm.fdc.doubleDensity {
+		vm.fdc.byteCount = trackSizeDd
+	} else {
+		vm.fdc.byteCount = trackSizeSd
+	}
+	vm.fdc.status |= diskBusy
+	vm.addEvent(eventDiskFirstDrq, func() { vm.diskFirstDrq(0) }, 64)
+}
+
+// Parse one raw byte written during a Write Track command. The F5, F6, and F7
+// bytes are special: F7 writes a CRC, and in double density F5 and F6 write
+// the A1 and C2 sync bytes that precede address marks.
+func (vm *vm) diskWriteTrackByte(value byte) {
+	fdc := &vm.fdc
+	disk := &fdc.disks[fdc.currentDrive]
+
+	// DMK stores the raw track, so it doesn't need to parse the sectors.
+	if disk.emulationType == emuDmk {
+		disk.dmkWriteTrackByte(value, fdc.doubleDensity)
+		return
+	}
+
+	switch fdc.format {
+	case formatGap:
+		switch value {
+		case 0xFE:
+			// ID address mark.
+			fdc.format = formatTrackId
+		case 0xFB, 0xFA, 0xF9, 0xF8:
+			// Data address mark.
+			if fdc.formatIdValid {
+				vm.diskFormatSector(value)
+				fdc.formatIdValid = false
+				fdc.format = formatData
+			}
+		default:
+			// Gap, sync, or index address mark.
+		}
+	case formatTrackId:
+		fdc.formatTrack = value
+		if value != disk.physicalTrack {
+			log.Printf("Formatting track %d with ID of track %d", disk.physicalTrack, value)
+		}
+		fdc.format = formatSideId
+	case formatSideId:
+		if side(value) != fdc.side {
+			log.Printf("Formatting side %d with ID of side %d", fdc.side, value)
+		}
+		fdc.format = formatSectorId
+	case formatSectorId:
+		fdc.formatSector = value
+		fdc.format = formatSizeId
+	case formatSizeId:
+		fdc.formatSizeCode = value & 0x03
+		fdc.format = formatIdCrc
+	case formatIdCrc:
+		if value != 0xF7 {
+			log.Printf("Expected ID CRC while formatting but got %02X", value)
+		}
+		fdc.formatIdValid = true
+		fdc.format = formatGap
+	case formatData:
+		if fdc.formatDataOffset >= 0 {
+			disk.setByte(fdc.formatDataOffset, value)
+			fdc.formatDataOffset++
+		}
+		fdc.formatDataLeft--
+		if fdc.formatDataLeft <= 0 {
+			fdc.format = formatDataCrc
+		}
+	case formatDataCrc:
+		if value != 0xF7 {
+			log.Printf("Expected data CRC while formatting but got %02X", value)
+		}
+		fdc.format = formatGap
+	}
+}
+
+// Create the sector described by the last ID field seen while formatting,
+// with the given data address mark. Sets up formatDataOffset and
+// formatDataLeft for its data.
+func (vm *vm) diskFormatSector(dam byte) {
+	fdc := &vm.fdc
+	disk := &fdc.disks[fdc.currentDrive]
+
+	size := 128 << fdc.formatSizeCode
+	fdc.formatDataLeft = size
+	fdc.formatDataOffset = -1
+
+	switch disk.emulationType {
+	case emuJv1:
+		if fdc.doubleDensity || fdc.side != 0 || size != jv1BytesPerSector ||
+			fdc.formatSector >= jv1SectorsPerTrack {
+
+			log.Printf("Can't format sector %d (%d bytes) on JV1 track %d",
+				fdc.formatSector, size, disk.physicalTrack)
+		} else {
+			fdc.formatDataOffset = disk.getDataOffset(
+				jv1SectorsPerTrack*int(disk.physicalTrack) + int(fdc.formatSector))
+		}
+	case emuJv3:
+		// JV3 can only store sectors whose ID matches where they are on the disk.
+		newId := jv3Sector{
+			track:  disk.physicalTrack,
+			sector: fdc.formatSector,
+			flags:  jv3SizeFlags(fdc.formatSizeCode),
+		}
+		newId.flags |= jv3DamFlags(dam, fdc.doubleDensity)
+		if fdc.doubleDensity {
+			newId.flags |= jv3Density
+		}
+		if fdc.side != 0 {
+			newId.flags |= jv3Side
+		}
+
+		idIndex := disk.addJv3Sector(newId)
+		if idIndex == -1 {
+			log.Printf("No room on JV3 disk for sector %d of track %d",
+				fdc.formatSector, disk.physicalTrack)
+		} else {
+			fdc.formatDataOffset = disk.getDataOffset(idIndex)
+		}
+	}
+}
+
+// Write back the data of the current drive to its file.
+func (vm *vm) flushDisk() {
+	disk := &vm.fdc.disks[vm.fdc.currentDrive]
+
+	err := disk.flush()
+	if err != nil {
+		log.Printf("Can't write to disk \"%s\": %s", disk.filename, err)
+	}
+}
+
 // Set the track register for later reads.
 func (vm *vm) writeDiskTrack(value byte) {
 	if diskDebug {
@@ -871,18 +1807,58 @@ func (vm *vm) writeDiskSector(value byte) {
 	vm.fdc.sector = value
 }
 
-// Write to the data register. We don't support writing to the diskette,
-// but the register is used by other commands, such as seeking.
+// Write to the data register. This is used for writing sectors to the
+// diskette, but also by other commands, such as seeking.
 func (vm *vm) writeDiskData(value byte) {
+	disk := &vm.fdc.disks[vm.fdc.currentDrive]
+
 	if diskDebug {
 		log.Printf("writeDiskData(%02X)", value)
 	}
 
-	switch vm.fdc.currentCommand & diskCommandMask {
-	case diskWrite:
-		panic("diskWrite")
+	cmd := vm.fdc.currentCommand
+	switch cmd & diskCommandMask {
+	case diskWrite, diskWriteM:
+		// Keep writing to the sector.
+		if vm.fdc.byteCount > 0 && (vm.fdc.status&diskDrq) != 0 {
+			disk.putDataByte(value)
+			vm.fdc.byteCount--
+			if vm.fdc.byteCount <= 0 {
+				vm.fdc.byteCount = 0
+				vm.fdc.status &^= diskDrq
+				vm.diskDrqInterrupt(false)
+				vm.events.cancelEvents(eventDiskLostData)
+				if disk.emulationType == emuDmk {
+					disk.writeDmkDataCrc(vm.fdc.doubleDensity)
+				}
+				vm.flushDisk()
+				if cmd&diskMMask != 0 {
+					// Move on to the next sector. We stop with Record
+					// Not Found when we run off the end of the track.
+					vm.fdc.sector++
+					vm.addEvent(eventDiskFirstDrq, func() { vm.diskStartWrite(cmd) }, 64)
+				} else {
+					vm.addEvent(eventDiskDone, func() { vm.diskDone(0) }, 64)
+				}
+			}
+		}
 	case diskWriteTrk:
-		panic("diskWriteTrk")
+		// Keep parsing the raw track.
+		if vm.fdc.byteCount > 0 && (vm.fdc.status&diskDrq) != 0 {
+			vm.diskWriteTrackByte(value)
+			vm.fdc.byteCount--
+			if vm.fdc.byteCount <= 0 {
+				vm.fdc.byteCount = 0
+				vm.fdc.status &^= diskDrq
+				vm.diskDrqInterrupt(false)
+				vm.events.cancelEvents(eventDiskLostData)
+				if disk.emulationType == emuDmk {
+					disk.dmkFinishWriteTrack(vm.fdc.doubleDensity)
+				}
+				vm.flushDisk()
+				vm.addEvent(eventDiskDone, func() { vm.diskDone(0) }, 64)
+			}
+		}
 	default:
 		// No action, just fall through and store data.
 		break
@@ -897,12 +1873,14 @@ func (vm *vm) writeDiskSelect(value byte) {
 		log.Printf("writeDiskSelect(%02X)", value)
 	}
 
+	wasReady := vm.fdc.status&diskNotRdy == 0
 	vm.fdc.status &^= diskNotRdy
 	vm.fdc.side.setFromBoolean((value & diskSide) != 0)
 	vm.fdc.doubleDensity = (value & diskMfm) != 0
 	if value&diskWait != 0 {
 		// If there was an event pending, simulate waiting until it was due.
-		event := vm.events.getFirstEvent(eventDisk &^ eventDiskLostData)
+		// The index pulse isn't the end of an operation.
+		event := vm.events.getFirstEvent(eventDisk &^ (eventDiskLostData | eventDiskIndex))
 		if event != nil {
 			if diskDebug {
 				log.Printf("Advancing clock from %d to %d", vm.clock, event.clock)
@@ -938,9 +1916,11 @@ func (vm *vm) writeDiskSelect(value byte) {
 	if vm.fdc.status&diskNotRdy == 0 {
 		vm.setDiskMotor(true)
 		// XXX Could replace this with an event.
-		vm.fdc.motorTimeout = vm.clock + motorTimeAfterSelect*cpuHz
+		vm.fdc.motorTimeout = vm.clock + motorTimeAfterSelect*vm.cpuHz()
 		vm.diskMotorOffInterrupt(false)
 	}
+
+	vm.checkDiskReadyInterrupt(wasReady)
 }
 
 // Search for a sector on the current physical track.  Return its index within
@@ -1016,11 +1996,264 @@ func (vm *vm) searchSector(sector int, side side) int {
 		}
 		vm.fdc.status |= diskNotFound
 		return -1
+	case emuDmk:
+		// The ID fields can say anything, so compare them with the track
+		// register and the requested side.
+		for _, idam := range disk.dmkIdams(disk.physicalTrack, vm.fdc.side, vm.fdc.doubleDensity) {
+			field := disk.dmkIdField(idam, vm.fdc.doubleDensity)
+			if field[0] == vm.fdc.track &&
+				(side == -1 || field[1] == byte(side)) &&
+				(sector == -1 || int(field[2]) == sector) {
+
+				disk.dmk.doubleDensity = vm.fdc.doubleDensity
+				return idam
+			}
+		}
+		vm.fdc.status |= diskNotFound
+		return -1
 	}
 
 	panic("Unhandled case in searchSector()")
 }
 
+// Return the index of every sector on the current physical track and side
+// that can be read at the current density, in the order in which they appear
+// on the track.
+func (vm *vm) trackSectors() []int {
+	disk := &vm.fdc.disks[vm.fdc.currentDrive]
+	var sectors []int
+
+	switch disk.emulationType {
+	case emuJv1:
+		if !vm.fdc.doubleDensity && vm.fdc.side == 0 {
+			for sector := 0; sector < jv1SectorsPerTrack; sector++ {
+				sectors = append(sectors, jv1SectorsPerTrack*int(disk.physicalTrack)+sector)
+			}
+		}
+	case emuJv3:
+		if vm.fdc.side >= jv3MaxSides {
+			break
+		}
+		if !disk.jv3.sortedValid {
+			disk.jv3.sortIds()
+		}
+		i := disk.jv3.trackStart[disk.physicalTrack][vm.fdc.side]
+		if i != -1 {
+			for {
+				id := disk.jv3.sortedId[i]
+				sid := &disk.jv3.id[id]
+				if sid.track != disk.physicalTrack ||
+					sid.side() != vm.fdc.side {
+
+					break
+				}
+				if sid.doubleDensity() == vm.fdc.doubleDensity {
+					sectors = append(sectors, id)
+				}
+				i++
+			}
+		}
+	case emuDmk:
+		sectors = disk.dmkIdams(disk.physicalTrack, vm.fdc.side, vm.fdc.doubleDensity)
+		disk.dmk.doubleDensity = vm.fdc.doubleDensity
+	}
+
+	return sectors
+}
+
+// Find the sector whose ID field is the next to go under the head, based on
+// the rotation of the disk. Return its index, or set status and return -1 if
+// the track has no sectors.
+func (vm *vm) searchAddress() int {
+	sectors := vm.trackSectors()
+	if len(sectors) == 0 {
+		vm.fdc.status |= diskNotFound
+		return -1
+	}
+
+	// Assume the sectors are spread evenly around the track.
+	i := int(vm.diskAngle()*float32(len(sectors))) % len(sectors)
+
+	// Don't return the same one twice in a row, since the disk will have
+	// turned by the time the program asks again.
+	if sectors[i] == vm.fdc.lastReadAdr {
+		i = (i + 1) % len(sectors)
+	}
+
+	return sectors[i]
+}
+
+// Return the ID field of a sector: track, side, sector, size code, and two
+// bytes of CRC.
+func (disk *disk) idField(index int, doubleDensity bool) []byte {
+	var field []byte
+
+	switch disk.emulationType {
+	case emuJv1:
+		field = []byte{
+			byte(index / jv1SectorsPerTrack),
+			0,
+			byte(index % jv1SectorsPerTrack),
+			1,
+		}
+	case emuJv3:
+		id := &disk.jv3.id[index]
+		field = []byte{id.track, byte(id.side()), id.sector, id.getSizeCode()}
+	case emuDmk:
+		// Return the CRC that's on the disk, even if it's wrong.
+		return disk.dmkIdField(index, doubleDensity)
+	default:
+		panic("Unhandled case in idField()")
+	}
+
+	crc := addressMarkCrc(0xFE, doubleDensity)
+	for _, b := range field {
+		crc = updateCrc(crc, b)
+	}
+
+	return append(field, byte(crc>>8), byte(crc))
+}
+
+// Return the data address mark of a sector. JV1 doesn't store it, so the
+// directory track gets directoryDam, which depends on the machine.
+func (disk *disk) dataAddressMark(index int, directoryDam byte) byte {
+	switch disk.emulationType {
+	case emuJv1:
+		if index/jv1SectorsPerTrack == jv1DirectoryTrack {
+			return directoryDam
+		}
+		return 0xFB
+	case emuJv3:
+		return disk.jv3.id[index].dam()
+	case emuDmk:
+		dam := disk.dmkDataAddressMark(index, disk.dmk.doubleDensity)
+		if dam == -1 {
+			return 0xFB
+		}
+		return disk.data[dam]
+	}
+
+	panic("Unhandled case in dataAddressMark()")
+}
+
+// Return the number of data bytes in a sector.
+func (disk *disk) sectorSize(index int, doubleDensity bool) int {
+	switch disk.emulationType {
+	case emuJv1:
+		return jv1BytesPerSector
+	case emuJv3:
+		return disk.jv3.id[index].getSize()
+	case emuDmk:
+		return 128 << (disk.dmkIdField(index, doubleDensity)[3] & 0x03)
+	}
+
+	panic("Unhandled case in sectorSize()")
+}
+
+// Synthesize the raw bytes of the current track, as the controller would see
+// them during a Read Track command. We use standard IBM gap sizes.
+func (vm *vm) diskTrackImage() []byte {
+	disk := &vm.fdc.disks[vm.fdc.currentDrive]
+	doubleDensity := vm.fdc.doubleDensity
+
+	// DMK has the real thing.
+	if disk.emulationType == emuDmk {
+		track := disk.dmkRawTrack(disk.physicalTrack, vm.fdc.side, doubleDensity)
+		if track != nil {
+			return track
+		}
+	}
+
+	// Gap and sync bytes differ by density.
+	var gapByte byte
+	var trackSize, gap4a, gap1, gap2, gap3, syncSize, syncMarks int
+	if doubleDensity {
+		gapByte, trackSize = 0x4E, trackSizeDd
+		gap4a, gap1, gap2, gap3, syncSize, syncMarks = 80, 50, 22, 24, 12, 3
+	} else {
+		gapByte, trackSize = 0xFF, trackSizeSd
+		gap4a, gap1, gap2, gap3, syncSize, syncMarks = 40, 26, 11, 27, 6, 0
+	}
+
+	track := make([]byte, 0, trackSize)
+	appendBytes := func(b byte, count int) {
+		for i := 0; i < count; i++ {
+			track = append(track, b)
+		}
+	}
+	// Sync field followed by an address mark.
+	appendMark := func(mark byte, syncMark byte) {
+		appendBytes(0x00, syncSize)
+		appendBytes(syncMark, syncMarks)
+		track = append(track, mark)
+	}
+
+	// Index address mark.
+	appendBytes(gapByte, gap4a)
+	appendMark(0xFC, 0xC2)
+	appendBytes(gapByte, gap1)
+
+	for _, index := range vm.trackSectors() {
+		// ID field.
+		appendMark(0xFE, 0xA1)
+		track = append(track, disk.idField(index, doubleDensity)...)
+		appendBytes(gapByte, gap2)
+
+		// Data field.
+		dam := disk.dataAddressMark(index, vm.jv1DirectoryDam())
+		appendMark(dam, 0xA1)
+		crc := addressMarkCrc(dam, doubleDensity)
+		offset := disk.getDataOffset(index)
+		step := 1
+		if disk.emulationType == emuDmk {
+			step = disk.dmk.byteStep(doubleDensity)
+		}
+		size := disk.sectorSize(index, doubleDensity)
+		for i := 0; i < size; i++ {
+			b := byte(0xE5)
+			if offset >= 0 && offset+i*step < len(disk.data) {
+				b = disk.data[offset+i*step]
+			}
+			track = append(track, b)
+			crc = updateCrc(crc, b)
+		}
+		track = append(track, byte(crc>>8), byte(crc))
+		appendBytes(gapByte, gap3)
+	}
+
+	// Fill the rest of the track with gap, or cut it off if it doesn't fit.
+	if len(track) < trackSize {
+		appendBytes(gapByte, trackSize-len(track))
+	}
+	return track[:trackSize]
+}
+
+// Return the CRC after an address mark. In double density the mark is
+// preceded by three A1 bytes that are included in the CRC.
+func addressMarkCrc(mark byte, doubleDensity bool) uint16 {
+	crc := uint16(0xFFFF)
+	if doubleDensity {
+		crc = updateCrc(crc, 0xA1)
+		crc = updateCrc(crc, 0xA1)
+		crc = updateCrc(crc, 0xA1)
+	}
+	return updateCrc(crc, mark)
+}
+
+// Add a byte to a CRC-CCITT, which is what the controller uses for both ID and
+// data fields.
+func updateCrc(crc uint16, b byte) uint16 {
+	crc ^= uint16(b) << 8
+	for i := 0; i < 8; i++ {
+		if crc&0x8000 != 0 {
+			crc = crc<<1 ^ 0x1021
+		} else {
+			crc <<= 1
+		}
+	}
+	return crc
+}
+
 // Get the byte offset of the given sector.
 func (disk *disk) getDataOffset(index int) int {
 	switch disk.emulationType {
@@ -1028,6 +2261,13 @@ func (disk *disk) getDataOffset(index int) int {
 		return index * jv1BytesPerSector
 	case emuJv3:
 		return disk.jv3.offset[index]
+	case emuDmk:
+		// The data follows the data address mark, if there is one.
+		dam := disk.dmkDataAddressMark(index, disk.dmk.doubleDensity)
+		if dam == -1 {
+			return -1
+		}
+		return dam + disk.dmk.byteStep(disk.dmk.doubleDensity)
 	}
 
 	panic("Unimplemented case in getDataOffset()")
@@ -1049,7 +2289,7 @@ func (vm *vm) diskVerify() {
 		} else if vm.fdc.track != disk.physicalTrack {
 			vm.fdc.status |= diskSeekErr
 		}
-	case emuJv3:
+	case emuJv3, emuDmk:
 		// diskSeekErr == diskNotFound
 		vm.searchSector(-1, -1)
 	}
@@ -1135,3 +2375,32 @@ func (vm *vm) updateDiskMotorLights() {
 		}
 	}
 }
+
+// Tell the UI whether the disk in a drive is write-protected.
+func (vm *vm) updateDiskWriteProtect(drive int) {
+	if vm.vmUpdateCh != nil {
+		var writeProtectedInt int
+		if vm.fdc.disks[drive].writeProtected {
+			writeProtectedInt = 1
+		} else {
+			writeProtectedInt = 0
+		}
+
+		vm.vmUpdateCh <- vmUpdate{Cmd: "write_protect", Addr: drive, Data: writeProtectedInt}
+	}
+}
+
+// Tell the UI whether the disk in a drive is an overlay, which has changes
+// that can be committed, discarded, or saved to another file.
+func (vm *vm) updateDiskOverlay(drive int) {
+	if vm.vmUpdateCh != nil {
+		var overlayInt int
+		if vm.fdc.disks[drive].overlay {
+			overlayInt = 1
+		} else {
+			overlayInt = 0
+		}
+
+		vm.vmUpdateCh <- vmUpdate{Cmd: "disk_overlay", Addr: drive, Data: overlayInt}
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2012 Lawrence Kesteloot
+
+package main
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+)
+
+// The dirty ranges cover exactly the bytes that were set, in order, and
+// ranges that touch are joined.
+func TestDirtyRanges(t *testing.T) {
+	const size = 200
+	disk := &disk{data: make([]byte, size)}
+	set := make([]bool, size)
+
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 150; i++ {
+		offset := random.Intn(size)
+		disk.setByte(offset, 1)
+		set[offset] = true
+	}
+
+	var expected []diskRange
+	for offset := 0; offset < size; offset++ {
+		if set[offset] && (offset == 0 || !set[offset-1]) {
+			expected = append(expected, diskRange{offset, offset + 1})
+		} else if set[offset] {
+			expected[len(expected)-1].end++
+		}
+	}
+
+	if len(disk.dirty) != len(expected) {
+		t.Fatalf("Got dirty ranges %v, expected %v", disk.dirty, expected)
+	}
+	for i := range expected {
+		if disk.dirty[i] != expected[i] {
+			t.Fatalf("Got dirty ranges %v, expected %v", disk.dirty, expected)
+		}
+	}
+}
+
+// Committing leaves alone the parts of the file that weren't changed, even
+// if they're between changed parts.
+func TestCommitOnlyDirty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "disk.dsk")
+	err = ioutil.WriteFile(filename, make([]byte, 100), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	disk := &disk{data: make([]byte, 100), filename: filename, overlay: true}
+	disk.setByte(10, 1)
+	disk.setByte(90, 2)
+
+	// Someone else changes the file in between.
+	other := make([]byte, 100)
+	other[50] = 3
+	err = ioutil.WriteFile(filename, other, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = disk.commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[10] != 1 || data[50] != 3 || data[90] != 2 {
+		t.Errorf("Got bytes %d, %d, %d, expected 1, 3, 2", data[10], data[50], data[90])
+	}
+}
+
+// A Step after a Restore goes out, like the Restore did.
+func TestRestoreThenStep(t *testing.T) {
+	vm := &vm{machine: machines[0]}
+	vm.diskInit(true)
+
+	// Step in to track 2, then restore to track 0.
+	vm.writeDiskCommand(diskStepIn)
+	vm.writeDiskCommand(diskStepIn)
+	vm.writeDiskCommand(diskRestore)
+
+	vm.writeDiskCommand(diskStep)
+	if track := vm.fdc.disks[0].physicalTrack; track != 0 {
+		t.Errorf("Head is on track %d, expected 0", track)
+	}
+}
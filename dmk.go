@@ -0,0 +1,396 @@
+// Copyright 2012 Lawrence Kesteloot
+
+package main
+
+// Support for the DMK disk format. Unlike JV1 and JV3, DMK stores the raw
+// bytes of each track as the controller would see them, including gaps,
+// address marks, and CRCs. That lets it represent copy-protected disks.
+//
+// The file starts with a 16-byte header. Each track follows, starting with a
+// table of 64 little-endian pointers to the ID address marks (IDAMs) on the
+// track, then the raw bytes. The top bit of each pointer is set if the sector
+// is double density, and the rest is the offset of the 0xFE byte from the
+// start of the track (including the table). A zero pointer ends the table.
+// Unless the header says otherwise, single density bytes are written twice,
+// so that they take as much room as double density ones.
+
+import (
+	"fmt"
+	"log"
+)
+
+const (
+	// Header layout.
+	dmkHeaderSize   = 16
+	dmkWriteProtect = 0  // 0xFF if write-protected.
+	dmkTrackCount   = 1  // Number of tracks.
+	dmkTrackLength  = 2  // Little-endian length of each track, including the IDAM table.
+	dmkOptions      = 4  // See the dmkOption* bits.
+	dmkNativeFlag   = 12 // Four bytes, 0x12345678 if it's a real drive, not an image.
+
+	// Option bits.
+	dmkOptionSingleSided    = 0x10
+	dmkOptionSingleDensity  = 0x40 // Single density bytes aren't doubled.
+	dmkOptionIgnoreDensity  = 0x80 // No bytes are doubled.
+	dmkOptionUnusedBits     = 0x2F
+	dmkIdamTableSize        = 128 // Bytes at the start of each track.
+	dmkIdamCount            = dmkIdamTableSize / 2
+	dmkIdamDoubleDensity    = 0x8000 // Flag in an IDAM pointer.
+	dmkIdamOffsetMask       = 0x3FFF
+	dmkMaxTrackLength       = 0x4000
+	dmkDataAddressMarkRange = 43 // Bytes after the ID field to look for the DAM.
+)
+
+// DMK-specific data.
+type dmk struct {
+	trackCount  int  // Number of tracks on each side.
+	trackLength int  // Bytes per track, including the IDAM table.
+	sideCount   int  // 1 or 2.
+	singleByte  bool // Whether single density bytes are stored once instead of twice.
+
+	// Density of the sectors last looked up, which tells us whether their
+	// bytes are doubled.
+	doubleDensity bool
+
+	// Offset of the data address mark of the sector being written.
+	damOffset int
+
+	// Write Track state.
+	writeOffset int    // Offset of the next raw byte.
+	writeEnd    int    // Offset of the end of the track.
+	idamCount   int    // Number of IDAM pointers filled in.
+	crc         uint16 // CRC of the current field.
+	lastByte    byte   // Last byte written by the program.
+}
+
+// Parse the DMK header. Returns an error if it doesn't look like a DMK file.
+func (disk *disk) loadDmkData() error {
+	data := disk.data
+	if len(data) < dmkHeaderSize {
+		return fmt.Errorf("DMK file is too short (%d bytes)", len(data))
+	}
+
+	options := data[dmkOptions]
+	native := readLittleEndian32(data[dmkNativeFlag:])
+	if (data[dmkWriteProtect] != 0x00 && data[dmkWriteProtect] != 0xFF) ||
+		options&dmkOptionUnusedBits != 0 ||
+		(native != 0 && native != 0x12345678) {
+
+		return fmt.Errorf("Not a DMK header")
+	}
+	if native != 0 {
+		return fmt.Errorf("DMK header refers to a real drive")
+	}
+
+	dmk := &disk.dmk
+	dmk.trackCount = int(data[dmkTrackCount])
+	dmk.trackLength = int(data[dmkTrackLength]) | int(data[dmkTrackLength+1])<<8
+	if options&dmkOptionSingleSided != 0 {
+		dmk.sideCount = 1
+	} else {
+		dmk.sideCount = 2
+	}
+	dmk.singleByte = options&(dmkOptionSingleDensity|dmkOptionIgnoreDensity) != 0
+
+	if dmk.trackCount == 0 || dmk.trackCount > maxTracks ||
+		dmk.trackLength <= dmkIdamTableSize || dmk.trackLength > dmkMaxTrackLength {
+
+		return fmt.Errorf("Bad DMK geometry (%d tracks of %d bytes)",
+			dmk.trackCount, dmk.trackLength)
+	}
+	if len(data) < dmk.trackOffset(dmk.trackCount, 0) {
+		return fmt.Errorf("DMK file is truncated (%d bytes for %d tracks of %d bytes)",
+			len(data), dmk.trackCount, dmk.trackLength)
+	}
+
+	return nil
+}
+
+// Return the byte offset of the start of a track (its IDAM table).
+func (dmk *dmk) trackOffset(track, side int) int {
+	return dmkHeaderSize + (track*dmk.sideCount+side)*dmk.trackLength
+}
+
+// Return how many times each byte is stored at the given density.
+func (dmk *dmk) byteStep(doubleDensity bool) int {
+	if doubleDensity || dmk.singleByte {
+		return 1
+	}
+	return 2
+}
+
+// Return the offsets of the IDAMs (the 0xFE bytes) of the sectors on the
+// given track and side that can be read at the given density, in the order
+// in which they appear on the track.
+func (disk *disk) dmkIdams(track byte, side side, doubleDensity bool) []int {
+	dmk := &disk.dmk
+	var idams []int
+
+	if int(track) >= dmk.trackCount || int(side) >= dmk.sideCount {
+		return idams
+	}
+
+	trackStart := dmk.trackOffset(int(track), int(side))
+	for i := 0; i < dmkIdamCount; i++ {
+		pointer := int(disk.data[trackStart+2*i]) | int(disk.data[trackStart+2*i+1])<<8
+		if pointer == 0 {
+			break
+		}
+		offset := pointer & dmkIdamOffsetMask
+		if (pointer&dmkIdamDoubleDensity != 0) == doubleDensity &&
+			offset >= dmkIdamTableSize && offset+7*2 < dmk.trackLength {
+
+			idams = append(idams, trackStart+offset)
+		}
+	}
+
+	return idams
+}
+
+// Return the byte of a field that starts at offset, where index counts
+// from the start of the field.
+func (disk *disk) dmkByte(offset, index int, doubleDensity bool) byte {
+	return disk.data[offset+index*disk.dmk.byteStep(doubleDensity)]
+}
+
+// Return the ID field after the IDAM at the given offset: track, side,
+// sector, size code, and two bytes of CRC.
+func (disk *disk) dmkIdField(idam int, doubleDensity bool) []byte {
+	field := make([]byte, 6)
+	for i := range field {
+		field[i] = disk.dmkByte(idam, i+1, doubleDensity)
+	}
+	return field
+}
+
+// Return the offset of the data address mark that follows the ID field at
+// idam, or -1 if there isn't one.
+func (disk *disk) dmkDataAddressMark(idam int, doubleDensity bool) int {
+	step := disk.dmk.byteStep(doubleDensity)
+
+	// Skip the IDAM, four ID bytes, and the two CRC bytes.
+	offset := idam + 7*step
+	for i := 0; i < dmkDataAddressMarkRange && offset < len(disk.data); i++ {
+		b := disk.data[offset]
+		if b >= 0xF8 && b <= 0xFB {
+			return offset
+		}
+		if b == 0xFE {
+			// Next ID field, this sector has no data.
+			break
+		}
+		offset += step
+	}
+
+	return -1
+}
+
+// Return the data of a track as the controller would read it, without the
+// IDAM table and with single density bytes undoubled.
+func (disk *disk) dmkRawTrack(track byte, side side, doubleDensity bool) []byte {
+	dmk := &disk.dmk
+	if int(track) >= dmk.trackCount || int(side) >= dmk.sideCount {
+		return nil
+	}
+
+	step := dmk.byteStep(doubleDensity)
+	start := dmk.trackOffset(int(track), int(side)) + dmkIdamTableSize
+	end := start + dmk.trackLength - dmkIdamTableSize
+	raw := make([]byte, 0, (end-start)/step)
+	for offset := start; offset < end && offset < len(disk.data); offset += step {
+		raw = append(raw, disk.data[offset])
+	}
+
+	return raw
+}
+
+// Return whether the ID field at idam or the data field at dam, of size
+// bytes, has a bad CRC.
+func (disk *disk) dmkCrcError(idam, dam, size int, doubleDensity bool) bool {
+	field := disk.dmkIdField(idam, doubleDensity)
+	crc := addressMarkCrc(0xFE, doubleDensity)
+	for _, b := range field[:4] {
+		crc = updateCrc(crc, b)
+	}
+	if crc != uint16(field[4])<<8|uint16(field[5]) {
+		return true
+	}
+
+	step := disk.dmk.byteStep(doubleDensity)
+	end := dam + (size+3)*step
+	if end > len(disk.data) {
+		return true
+	}
+	crc = addressMarkCrc(disk.data[dam], doubleDensity)
+	for offset := dam + step; offset < end-2*step; offset += step {
+		crc = updateCrc(crc, disk.data[offset])
+	}
+	return crc != uint16(disk.data[end-2*step])<<8|uint16(disk.data[end-step])
+}
+
+// Compute the CRC of the sector data that ends at the current data offset
+// and write it after the data. Used after writing a sector.
+func (disk *disk) writeDmkDataCrc(doubleDensity bool) {
+	step := disk.dmk.byteStep(doubleDensity)
+
+	crc := addressMarkCrc(disk.data[disk.dmk.damOffset], doubleDensity)
+	for offset := disk.dmk.damOffset + step; offset < disk.dataOffset; offset += step {
+		crc = updateCrc(crc, disk.data[offset])
+	}
+	disk.putDataByte(byte(crc >> 8))
+	disk.putDataByte(byte(crc))
+}
+
+// Return the sizes of the gap, sync bytes, and sync marks that precede a
+// data address mark, and the gap byte.
+func dmkDataSync(doubleDensity bool) (gap, sync, syncMarks int, gapByte byte) {
+	if doubleDensity {
+		return 22, 12, 3, 0x4E
+	}
+	return 11, 6, 0, 0xFF
+}
+
+// Return the offset at which writeDmkDataSync() would put the data address
+// mark for the ID field at idam.
+func (disk *disk) dmkNewDataAddressMark(idam int, doubleDensity bool) int {
+	gap, sync, syncMarks, _ := dmkDataSync(doubleDensity)
+
+	// The ID field, then the gap and sync.
+	return idam + (7+gap+sync+syncMarks)*disk.dmk.byteStep(doubleDensity)
+}
+
+// Write the bytes that precede a data address mark, for a sector that was
+// formatted without one. Returns the offset of the data address mark.
+func (disk *disk) writeDmkDataSync(idam int, doubleDensity bool) int {
+	step := disk.dmk.byteStep(doubleDensity)
+
+	// Skip the ID field and the gap after it.
+	disk.dataOffset = idam + 7*step
+	gap, sync, syncMarks, gapByte := dmkDataSync(doubleDensity)
+	for i := 0; i < gap; i++ {
+		disk.putDataByte(gapByte)
+	}
+	for i := 0; i < sync; i++ {
+		disk.putDataByte(0x00)
+	}
+	for i := 0; i < syncMarks; i++ {
+		disk.putDataByte(0xA1)
+	}
+
+	return disk.dataOffset
+}
+
+// Return the offset just past the end of the track that contains offset.
+func (dmk *dmk) trackEnd(offset int) int {
+	return offset + dmk.trackLength - (offset-dmkHeaderSize)%dmk.trackLength
+}
+
+// Get ready to write a whole track. Clears the IDAM table, adding tracks to
+// the file if necessary.
+func (disk *disk) dmkStartWriteTrack(track byte, side side) bool {
+	dmk := &disk.dmk
+	if int(side) >= dmk.sideCount {
+		log.Printf("Can't format side %d of single-sided DMK disk", side)
+		return false
+	}
+
+	// Add tracks.
+	if int(track) >= dmk.trackCount {
+		dmk.trackCount = int(track) + 1
+		disk.setByte(dmkTrackCount, byte(dmk.trackCount))
+		if end := dmk.trackOffset(dmk.trackCount, 0); len(disk.data) < end {
+			disk.setByte(end-1, 0)
+		}
+	}
+
+	trackStart := dmk.trackOffset(int(track), int(side))
+	for i := 0; i < dmkIdamTableSize; i++ {
+		disk.setByte(trackStart+i, 0)
+	}
+	dmk.writeOffset = trackStart + dmkIdamTableSize
+	dmk.writeEnd = trackStart + dmk.trackLength
+	dmk.idamCount = 0
+	dmk.crc = 0xFFFF
+	dmk.lastByte = 0
+
+	return true
+}
+
+// Write one byte of a Write Track command to the raw track. The F5, F6, and
+// F7 bytes are translated, and IDAM pointers are recorded.
+func (disk *disk) dmkWriteTrackByte(value byte, doubleDensity bool) {
+	dmk := &disk.dmk
+	trackStart := dmk.writeEnd - dmk.trackLength
+
+	raw := []byte{value}
+	if doubleDensity {
+		switch value {
+		case 0xF5:
+			// Sync byte with missing clock. Presets the CRC to what
+			// it would be after the three of them.
+			raw[0] = 0xA1
+			dmk.crc = 0xCDB4
+		case 0xF6:
+			// Index sync byte.
+			raw[0] = 0xC2
+			dmk.crc = updateCrc(dmk.crc, raw[0])
+		case 0xF7:
+			raw = []byte{byte(dmk.crc >> 8), byte(dmk.crc)}
+		default:
+			dmk.crc = updateCrc(dmk.crc, value)
+		}
+	} else {
+		switch {
+		case value == 0xF7:
+			raw = []byte{byte(dmk.crc >> 8), byte(dmk.crc)}
+		case value >= 0xF8 && value <= 0xFE && dmk.lastByte == 0x00:
+			// Address marks follow the zero sync bytes and preset the CRC.
+			dmk.crc = updateCrc(0xFFFF, value)
+		default:
+			dmk.crc = updateCrc(dmk.crc, value)
+		}
+	}
+
+	// Record ID address marks, which follow the sync bytes.
+	isMark := (doubleDensity && dmk.lastByte == 0xF5) || (!doubleDensity && dmk.lastByte == 0x00)
+	if value == 0xFE && isMark &&
+		dmk.idamCount < dmkIdamCount && dmk.writeOffset < dmk.writeEnd {
+
+		pointer := dmk.writeOffset - trackStart
+		if doubleDensity {
+			pointer |= dmkIdamDoubleDensity
+		}
+		disk.setByte(trackStart+2*dmk.idamCount, byte(pointer))
+		disk.setByte(trackStart+2*dmk.idamCount+1, byte(pointer>>8))
+		dmk.idamCount++
+	}
+	dmk.lastByte = value
+
+	// Write the bytes, doubled if necessary, until we run out of track.
+	step := dmk.byteStep(doubleDensity)
+	for _, b := range raw {
+		for i := 0; i < step && dmk.writeOffset < dmk.writeEnd; i++ {
+			disk.setByte(dmk.writeOffset, b)
+			dmk.writeOffset++
+		}
+	}
+}
+
+// Fill the rest of the track after a Write Track command.
+func (disk *disk) dmkFinishWriteTrack(doubleDensity bool) {
+	dmk := &disk.dmk
+
+	var gapByte byte = 0xFF
+	if doubleDensity {
+		gapByte = 0x4E
+	}
+	for dmk.writeOffset < dmk.writeEnd {
+		disk.setByte(dmk.writeOffset, gapByte)
+		dmk.writeOffset++
+	}
+}
+
+// Decode a little-endian 32-bit number.
+func readLittleEndian32(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+}
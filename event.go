@@ -13,9 +13,10 @@ const (
 	eventDiskLostData
 	eventDiskFirstDrq
 	eventKickOffCassette
+	eventDiskIndex
 
 	// Masks for multiple events.
-	eventDisk = eventDiskDone | eventDiskLostData | eventDiskFirstDrq
+	eventDisk = eventDiskDone | eventDiskLostData | eventDiskFirstDrq | eventDiskIndex
 )
 
 type eventType uint
@@ -44,11 +45,11 @@ func (vm *vm) addEvent(eventType eventType, callback eventCallback, deltaClock u
 func (events *events) add(eventType eventType, callback eventCallback, clock uint64) {
 	event := &event{eventType, callback, clock, nil}
 
-	// Insert into list sorted by clock.
+	// Insert into list sorted by clock, after events at the same clock.
 	eventPtr := &events.head
 	place := 0
-	for *eventPtr != nil && (*eventPtr).clock < clock {
-		*eventPtr = (*eventPtr).next
+	for *eventPtr != nil && (*eventPtr).clock <= clock {
+		eventPtr = &(*eventPtr).next
 		place++
 	}
 
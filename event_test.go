@@ -0,0 +1,38 @@
+// Copyright 2012 Lawrence Kesteloot
+
+package main
+
+import (
+	"testing"
+)
+
+// Events are dispatched in the order of their clocks, and in the order they
+// were added when their clocks are the same. None are lost when others are
+// inserted in front of them.
+func TestEventOrder(t *testing.T) {
+	var events events
+	var order []int
+
+	add := func(id int, clock uint64) {
+		events.add(eventDiskDone, func() { order = append(order, id) }, clock)
+	}
+	add(1, 30)
+	add(2, 10)
+	add(3, 20)
+	add(4, 20)
+	add(5, 40)
+	add(6, 10)
+
+	events.dispatch(25)
+	events.dispatch(100)
+
+	expected := []int{2, 6, 3, 4, 1, 5}
+	if len(order) != len(expected) {
+		t.Fatalf("Dispatched %v, expected %v", order, expected)
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Fatalf("Dispatched %v, expected %v", order, expected)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2012 Lawrence Kesteloot
+
+package main
+
+// Fast loading of cassettes. Instead of emulating the ROM routines that read
+// the tape one pulse at a time, we decode the whole tape into bytes up front
+// and run the routines ourselves. Programs with their own loaders don't call
+// these routines, so they still read the tape through the analog emulation.
+
+// A routine we run ourselves instead of emulating it. It returns whether it
+// ran. If not, the CPU executes the instruction at the PC.
+type pcHook func(vm *vm) bool
+
+// ROM routines we run ourselves, by PC. They're only run when the ROM is
+// mapped at the PC.
+var romHooks = map[uint16]pcHook{
+	0x0296: (*vm).fastCassetteSync, // $CSHIN
+	0x0235: (*vm).fastCassetteByte, // $CSIN
+}
+
+// Return the routine we run ourselves instead of the instruction at the PC,
+// or nil if there isn't one.
+func (vm *vm) pcHook() pcHook {
+	pc := vm.z80.PC()
+
+	// Only the ROM has its routines; on the Model 4 the PC may be in RAM
+	// that's mapped where the ROM would be.
+	if *fastCassette && vm.cc.motorOn && vm.isRom(pc) {
+		if hook, ok := romHooks[pc]; ok {
+			return hook
+		}
+	}
+
+	return vm.pcHooks[pc]
+}
+
+// Return the decoded tape, or nil if fast loading doesn't apply right now.
+func (vm *vm) fastCassetteTape() *cassetteTape {
+	cc := &vm.cc
+
+	// Leave the tape alone if something is already reading it the slow way.
+	// Level I has different routines.
+	if !*fastCassette || !vm.machine.romCassetteRoutines || !cc.motorOn || cc.state != cassetteStateClose || cc.cassette == nil {
+		return nil
+	}
+
+	return cc.tape
+}
+
+// Return the index of the next byte of the tape.
+func (vm *vm) tapeByte() int {
+	cc := &vm.cc
+	return cc.tape.byteAt(cc.tapeSample, cc.cassette.sampleRate())
+}
+
+// $CSHIN: Skip the leader and the sync byte.
+func (vm *vm) fastCassetteSync() bool {
+	tape := vm.fastCassetteTape()
+	if tape == nil {
+		return false
+	}
+
+	next := vm.tapeByte()
+	for _, block := range tape.blocks {
+		if block.sync >= next {
+			vm.seekCassette(tape.byteEnd(block.sync))
+
+			// The ROM shows two asterisks at the top-right of the screen.
+			// The screen is always at 0x3C00 when the ROM is mapped, but
+			// make sure these don't end up in RAM.
+			vm.writeScreenMem(0x3C3E, '*')
+			vm.writeScreenMem(0x3C3F, '*')
+
+			vm.simulateRet()
+			return true
+		}
+	}
+
+	// No more sync bytes. Let the ROM search the rest of the tape.
+	return false
+}
+
+// $CSIN: Read the next byte into A.
+func (vm *vm) fastCassetteByte() bool {
+	tape := vm.fastCassetteTape()
+	if tape == nil {
+		return false
+	}
+
+	i := vm.tapeByte()
+	if i >= len(tape.data) {
+		return false
+	}
+
+	vm.z80.A = tape.data[i]
+	vm.seekCassette(tape.byteEnd(i))
+
+	vm.simulateRet()
+	return true
+}
+
+// Write a byte to the screen at an address, if the screen is there.
+func (vm *vm) writeScreenMem(addr uint16, b byte) {
+	if vm.machine.model == model4 {
+		if region, _ := vm.model4Decode(addr); region != model4Video {
+			return
+		}
+	}
+
+	vm.writeMem(addr, b, true)
+}
+
+// Return from the routine we've just run ourselves.
+func (vm *vm) simulateRet() {
+	sp := vm.z80.SP()
+	vm.z80.SetPC(uint16(vm.readMem(sp)) | uint16(vm.readMem(sp+1))<<8)
+	vm.z80.SetSP(sp + 2)
+	vm.clock += 10
+}
@@ -17,6 +17,15 @@ const (
 	cassetteIrqMasks = cassetteRiseIrqMask | cassetteFallIrqMask
 )
 
+// The Model I has no interrupt mask. Its interrupt latch, read at 0x37E0,
+// has just these two bits.
+const (
+	model1DiskIrqMask  = 0x40
+	model1TimerIrqMask = 0x80
+
+	model1IrqMasks = model1DiskIrqMask | model1TimerIrqMask
+)
+
 // NMIs
 const (
 	resetNmiMask = 0x20 << iota
@@ -26,6 +35,10 @@ const (
 
 // Set the mask for IRQ (regular) interrupts.
 func (vm *vm) setIrqMask(irqMask byte) {
+	if vm.machine.model == model1 {
+		// Always enabled.
+		irqMask = model1IrqMasks
+	}
 	vm.irqMask = irqMask
 }
 
@@ -65,6 +78,16 @@ func (vm *vm) diskMotorOffInterrupt(state bool) {
 
 // Set the state of the disk interrupt.
 func (vm *vm) diskIntrqInterrupt(state bool) {
+	if vm.machine.model == model1 {
+		// The Model I's disk interrupt is a regular one.
+		if state {
+			vm.irqLatch |= model1DiskIrqMask
+		} else {
+			vm.irqLatch &^= model1DiskIrqMask
+		}
+		return
+	}
+
 	if state {
 		vm.nmiLatch |= diskIntrqNmiMask
 	} else {
@@ -92,6 +115,15 @@ func (vm *vm) cassetteFallInterrupt() {
 		(vm.irqMask & cassetteFallIrqMask)
 }
 
+// Read the Model I's interrupt latch at 0x37E0. This acknowledges the timer
+// interrupt.
+func (vm *vm) readModel1InterruptLatch() byte {
+	latch := vm.irqLatch & model1IrqMasks
+	vm.timerInterrupt(false)
+
+	return latch
+}
+
 // Reset cassette edge interrupts.
 func (vm *vm) cassetteClearInterrupt() {
 	vm.irqLatch &^= cassetteIrqMasks
@@ -0,0 +1,164 @@
+// Copyright 2012 Lawrence Kesteloot
+
+package main
+
+// The machines we can emulate, selected with the -model and -level flags.
+// They differ in their ROM, clock speed, memory map, and ports.
+
+import (
+	"fmt"
+)
+
+type machineModel int
+
+const (
+	model1 = machineModel(1)
+	model3 = machineModel(3)
+	model4 = machineModel(4)
+)
+
+// Description of a machine.
+type machine struct {
+	model machineModel
+
+	// Level of BASIC in ROM. Only the Model I has a choice.
+	level int
+
+	// For log messages and the UI.
+	name string
+
+	// Filename of the ROM in the ROM directory, and the most ROM the
+	// machine has room for.
+	romFilename string
+	romSize     int
+
+	// Bytes of RAM and video memory.
+	memorySize int
+	videoSize  int
+
+	// Index in memory of the first byte of RAM, and the sizes of RAM (in K)
+	// that the machine came with, smallest first.
+	ramStart int
+	ramSizes []int
+
+	// CPU clock. The Model 4 can also run at twice this speed.
+	cpuHz uint64
+
+	// Frequency of the timer interrupt.
+	timerHz uint64
+
+	// Speed of low-speed cassettes. Level I BASIC reads and writes tapes at
+	// half the speed of Level II.
+	cassetteBaud int
+
+	// Whether the ROM has the Level II cassette routines that fast loading
+	// replaces.
+	romCassetteRoutines bool
+}
+
+var machines = []*machine{
+	{
+		model:               model3,
+		level:               2,
+		name:                "Model III",
+		romFilename:         "model3.rom",
+		romSize:             0x3800,
+		memorySize:          64 * 1024,
+		videoSize:           1024,
+		ramStart:            ramBegin,
+		ramSizes:            []int{16, 32, 48},
+		cpuHz:               2027520, // 2.02752 MHz.
+		timerHz:             30,
+		cassetteBaud:        500,
+		romCassetteRoutines: true,
+	},
+	{
+		model:               model1,
+		level:               2,
+		name:                "Model I Level II",
+		romFilename:         "level2.rom",
+		romSize:             0x3000,
+		memorySize:          64 * 1024,
+		videoSize:           1024,
+		ramStart:            ramBegin,
+		ramSizes:            []int{4, 16, 32, 48},
+		cpuHz:               1774080, // 1.77408 MHz.
+		timerHz:             40,
+		cassetteBaud:        500,
+		romCassetteRoutines: true,
+	},
+	{
+		model:        model1,
+		level:        1,
+		name:         "Model I Level I",
+		romFilename:  "level1.rom",
+		romSize:      0x3000,
+		memorySize:   64 * 1024,
+		videoSize:    1024,
+		ramStart:     ramBegin,
+		ramSizes:     []int{4, 16, 32, 48},
+		cpuHz:        1774080,
+		timerHz:      40,
+		cassetteBaud: 250,
+	},
+	{
+		model:               model4,
+		level:               2,
+		name:                "Model 4",
+		romFilename:         "model4.rom",
+		romSize:             0x3800,
+		memorySize:          128 * 1024,
+		videoSize:           2048,
+		ramStart:            0,
+		ramSizes:            []int{64, 128},
+		cpuHz:               2027520,
+		timerHz:             60,
+		cassetteBaud:        500,
+		romCassetteRoutines: true,
+	},
+}
+
+// Return the machine selected by the -model and -level flags.
+func selectedMachine() (*machine, error) {
+	for _, m := range machines {
+		if int(m.model) == *modelFlag && (m.level == *levelFlag || m.model != model1) {
+			return m, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Unknown machine: Model %d, Level %d", *modelFlag, *levelFlag)
+}
+
+// Return the index in memory just past the end of RAM, given the size of
+// RAM in K, or 0 for the largest size the machine came with.
+func (m *machine) ramEnd(ramSize int) (int, error) {
+	if ramSize == 0 {
+		ramSize = m.ramSizes[len(m.ramSizes)-1]
+	}
+	for _, size := range m.ramSizes {
+		if size == ramSize {
+			return m.ramStart + ramSize*1024, nil
+		}
+	}
+
+	return 0, fmt.Errorf("The %s can't have %dK of RAM", m.name, ramSize)
+}
+
+// Current speed of the CPU.
+func (vm *vm) cpuHz() uint64 {
+	if vm.fastCpu {
+		return 2 * vm.machine.cpuHz
+	}
+
+	return vm.machine.cpuHz
+}
+
+// Nanoseconds per clock cycle.
+func (vm *vm) cpuPeriodNs() uint64 {
+	return 1000000000 / vm.cpuHz()
+}
+
+// Clock cycles between timer interrupts.
+func (vm *vm) timerCycles() uint64 {
+	return vm.cpuHz() / vm.machine.timerHz
+}
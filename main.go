@@ -12,16 +12,48 @@ import (
 const (
 	profileFilename     = "trs80emu.prof"
 	defaultCassettesDir = "cassettes"
+	defaultRomsDir      = "roms"
 )
 
 // Command-line flags.
 var profiling = flag.Bool("profile", false, "run for a few seconds and dump profiling file")
 var cassettesDir = flag.String("cassettes", defaultCassettesDir, "directory of cassettes")
 var webPort = flag.Uint("port", 8080, "Web port to listen to")
+var recordFormat = flag.String("record", "wav", "format of recorded cassettes (wav or cas)")
+var diskOverlays = flag.Bool("overlay", false, "keep disk writes in memory until they're committed, instead of changing the disk files")
+var invertCassette = flag.Bool("invert_cassette", false, "invert the polarity of cassettes being read")
+var fastCassette = flag.Bool("fast_cassette", false, "load cassettes instantly when programs use the ROM routines")
+var modelFlag = flag.Int("model", 3, "machine to emulate (1, 3, or 4 for the Model I, III, or 4)")
+var levelFlag = flag.Int("level", 2, "level of BASIC in the Model I's ROM (1 or 2)")
+var romsDir = flag.String("roms", defaultRomsDir, "directory of ROMs")
+var romFile = flag.String("rom", "", "ROM file to use instead of the machine's ROM in the ROM directory")
+var ramFlag = flag.Int("ram", 0, "K of RAM (4, 16, 32, or 48, or 64 or 128 on the Model 4), or 0 for the most")
+var speedFlag = flag.Int("speed", 1, "speed as a multiple of the real machine's (1, 2, or 4), or 0 for as fast as possible")
+var autoTurboFlag = flag.Bool("autoturbo", false, "run as fast as possible while a disk or cassette motor is running")
+var cassetteDiagnostics = flag.Bool("cassette_diagnostics", false, "report the baud rate and signal quality of cassettes being read")
 
 func main() {
 	flag.Parse()
 
+	if flag.Arg(0) == "tape" {
+		os.Exit(tapeCommand(flag.Args()[1:]))
+	}
+
+	// Check the configuration before we start.
+	machine, err := selectedMachine()
+	if err == nil {
+		_, err = machine.ramEnd(*ramFlag)
+	}
+	if err == nil {
+		_, err = loadRom(machine)
+	}
+	if err == nil {
+		err = checkSpeed(*speedFlag)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	if *profiling {
 		// When profiling don't run the web server, for some reason it causes
 		// the profile file to be empty.
@@ -32,7 +64,10 @@ func main() {
 }
 
 func profileSystem() {
-	vm := createVm(nil)
+	vm, err := createVm(nil)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	f, err := os.Create(profileFilename)
 	if err != nil {
@@ -42,7 +77,7 @@ func profileSystem() {
 	defer pprof.StopCPUProfile()
 
 	vm.reset(true)
-	for vm.clock < cpuHz*50 {
+	for vm.clock < vm.cpuHz()*50 {
 		vm.step()
 	}
 }
@@ -12,40 +12,40 @@ import (
 const (
 	// True RAM begins at this address.
 	ramBegin = 0x4000
+
+	// What we read where nothing drives the data bus.
+	floatingBus = 0xFF
+
+	// The Model I's expansion interface: the interrupt latch, drive select,
+	// printer, and floppy disk controller.
+	model1IoBegin = 0x37E0
+	model1IoEnd   = 0x37F0
 )
 
 // Write a byte to an address in memory.
 func (vm *vm) writeMem(addr uint16, b byte, protectRom bool) {
+	if vm.machine.model == model4 {
+		vm.writeModel4Mem(addr, b, protectRom)
+		return
+	}
+
 	// xtrs:trs_memory.c
-	// Check ROM writing. Harmless in real life, but may indicate a bug here.
 	if addr < vm.romSize {
 		// ROM.
-		if protectRom {
-			if crashOnRomWrite || logOnRomWrite {
-				msg := fmt.Sprintf("Warning: Tried to write %02X to ROM at %04X", b, addr)
-				vm.logHistoricalPc()
-				if crashOnRomWrite {
-					panic(msg)
-				} else {
-					log.Print(msg)
-				}
-			}
-		} else {
-			vm.memory[addr] = b
-			vm.memInit[addr] = true
-		}
+		vm.writeRom(addr, b, protectRom)
 	} else if addr >= ramBegin {
 		// RAM.
-		vm.memory[addr] = b
-		vm.memInit[addr] = true
+		vm.writeRam(int(addr), b)
 	} else if addr >= screenBegin && addr < screenEnd {
 		// Screen.
-		vm.memory[addr] = b
-		if vm.vmUpdateCh != nil {
-			vm.vmUpdateCh <- vmUpdate{Cmd: "poke", Addr: int(addr), Msg: string(b)}
+		if vm.machine.model == model1 {
+			b = model1VideoByte(b)
 		}
+		vm.writeVideo(int(addr-screenBegin), b)
 	} else if addr == 0x37E8 {
 		// Printer. Ignore, but could print ASCII byte to display.
+	} else if vm.machine.model == model1 && addr >= model1IoBegin && addr < model1IoEnd {
+		vm.writeModel1Io(addr, b)
 	} else {
 		// Ignore write anywhere else.
 	}
@@ -53,35 +53,155 @@ func (vm *vm) writeMem(addr uint16, b byte, protectRom bool) {
 
 // Read a byte from memory.
 func (vm *vm) readMem(addr uint16) (b byte) {
+	if vm.machine.model == model4 {
+		return vm.readModel4Mem(addr)
+	}
+
 	// Memory-mapped I/O.
 	// http://www.trs-80.com/trs80-zaps-internals.htm#memmapio
 	// xtrs:trs_memory.c
 	if addr < vm.romSize {
 		// ROM.
-		b = vm.memory[addr]
+		b = vm.rom[addr]
 	} else if addr >= ramBegin {
 		// RAM.
-		if warnUninitMemRead && !vm.memInit[addr] {
-			log.Printf("Warning: Uninitialized read of RAM at %04X", addr)
-		}
-		b = vm.memory[addr]
+		b = vm.readRam(int(addr))
 	} else if addr == 0x37E8 {
 		// Printer. 0x30 = Printer selected, ready, with paper, not busy.
 		b = 0x30
 	} else if addr >= screenBegin && addr < screenEnd {
 		// Screen.
-		b = vm.memory[addr]
+		b = vm.video[addr-screenBegin]
 	} else if addr >= keyboardBegin && addr < keyboardEnd {
 		// Keyboard.
 		b = vm.readKeyboard(addr)
+	} else if vm.machine.model == model1 && addr >= model1IoBegin && addr < model1IoEnd {
+		b = vm.readModel1Io(addr)
 	} else {
 		// Unmapped memory.
-		b = 0xFF
+		b = floatingBus
 	}
 
 	return
 }
 
+// Return the byte at an address without the side effects of reading it, for
+// the disassembler and debugging. Memory-mapped I/O reads as the floating
+// bus, since reading some of it acknowledges interrupts.
+func (vm *vm) peekMem(addr uint16) byte {
+	if vm.machine.model == model4 {
+		region, i := vm.model4Decode(addr)
+		switch region {
+		case model4Ram:
+			if i < vm.ramEnd {
+				return vm.memory[i]
+			}
+		case model4Rom:
+			return vm.rom[i]
+		case model4Video:
+			return vm.video[i]
+		}
+
+		return floatingBus
+	}
+
+	if addr < vm.romSize {
+		return vm.rom[addr]
+	} else if addr >= ramBegin {
+		if int(addr) < vm.ramEnd {
+			return vm.memory[addr]
+		}
+	} else if addr >= screenBegin && addr < screenEnd {
+		return vm.video[addr-screenBegin]
+	}
+
+	return floatingBus
+}
+
+// Return whether the address is in ROM in the current memory map.
+func (vm *vm) isRom(addr uint16) bool {
+	if vm.machine.model == model4 {
+		region, _ := vm.model4Decode(addr)
+		return region == model4Rom
+	}
+
+	return addr < vm.romSize
+}
+
+// Write a byte to ROM. Harmless in real life, but may indicate a bug here,
+// so it's only allowed when protectRom is false.
+func (vm *vm) writeRom(addr uint16, b byte, protectRom bool) {
+	if protectRom {
+		if crashOnRomWrite || logOnRomWrite {
+			msg := fmt.Sprintf("Warning: Tried to write %02X to ROM at %04X", b, addr)
+			vm.logHistoricalPc()
+			if crashOnRomWrite {
+				panic(msg)
+			} else {
+				log.Print(msg)
+			}
+		}
+	} else {
+		vm.rom[addr] = b
+	}
+}
+
+// Write a byte to RAM, given its index in memory. Writes past the installed
+// RAM are lost.
+func (vm *vm) writeRam(i int, b byte) {
+	if i < vm.ramEnd {
+		vm.memory[i] = b
+		vm.memInit[i] = true
+	}
+}
+
+// Read a byte from RAM, given its index in memory.
+func (vm *vm) readRam(i int) byte {
+	if i >= vm.ramEnd {
+		return floatingBus
+	}
+	if warnUninitMemRead && !vm.memInit[i] {
+		log.Printf("Warning: Uninitialized read of RAM at %05X", i)
+	}
+
+	return vm.memory[i]
+}
+
+// Write to the Model I's expansion interface.
+func (vm *vm) writeModel1Io(addr uint16, b byte) {
+	switch addr {
+	case 0x37E0, 0x37E1, 0x37E2, 0x37E3:
+		// Disk select. There's no side or density select.
+		vm.writeDiskSelect(b & diskDriveMask)
+	case 0x37EC:
+		vm.writeDiskCommand(b)
+	case 0x37ED:
+		vm.writeDiskTrack(b)
+	case 0x37EE:
+		vm.writeDiskSector(b)
+	case 0x37EF:
+		vm.writeDiskData(b)
+	}
+}
+
+// Read from the Model I's expansion interface.
+func (vm *vm) readModel1Io(addr uint16) byte {
+	switch addr {
+	case 0x37E0, 0x37E1, 0x37E2, 0x37E3:
+		return vm.readModel1InterruptLatch()
+	case 0x37EC:
+		return vm.readDiskStatus()
+	case 0x37ED:
+		return vm.readDiskTrack()
+	case 0x37EE:
+		return vm.readDiskSector()
+	case 0x37EF:
+		return vm.readDiskData()
+	}
+
+	return floatingBus
+}
+
 // The rest of the file is to satisfy the z80.MemoryAccessor interface, which the
 // z80 uses.
 func (vm *vm) ReadByte(address uint16) byte {
@@ -0,0 +1,152 @@
+// Copyright 2012 Lawrence Kesteloot
+
+package main
+
+// The Model 4's memory maps and banks, its 80x24 video, and its double-speed
+// CPU. Port 0x84 selects one of four memory maps:
+//
+//     0: Like the Model III: ROM, keyboard at 0x3800, video at 0x3C00, RAM.
+//     1: Like 0, but with RAM instead of ROM.
+//     2: RAM up to 0xF400, then the keyboard, then video at 0xF800.
+//     3: All RAM.
+//
+// It also selects which 32K banks of the 128K of RAM are used, and the video
+// mode. xtrs:trs_memory.c
+
+import (
+	"log"
+)
+
+// Bits of the Model 4's port 0x84.
+const (
+	model4MapMask    = 0x03 // Memory map, 0 to 3.
+	model4Video80    = 0x04 // 80x24 video instead of 64x16.
+	model4Inverse    = 0x08 // Characters 0x80 to 0xFF are inverse video.
+	model4Bank3      = 0x10 // Use bank 3 instead of bank 2...
+	model4BankSwitch = 0x20 // ...instead of the upper 32K (bank 1)...
+	model4BankLower  = 0x40 // ...or instead of the lower 32K (bank 0).
+	model4VideoPage  = 0x80 // Which 1K of video memory is at 0x3C00.
+)
+
+const (
+	// Where the keyboard and video are in memory map 2.
+	model4KeyboardBegin = 0xF400
+	model4VideoBegin    = 0xF800
+
+	// Port 0xEC bit that doubles the speed of the CPU.
+	model4FastCpu = 0x40
+)
+
+// What's at an address in the Model 4's memory.
+const (
+	model4Unmapped = iota
+	model4Ram
+	model4Rom
+	model4Keyboard
+	model4Video
+	model4Printer
+)
+
+// Find what's at the address in the current memory map, and its index in
+// RAM, ROM, the keyboard, or video memory.
+func (vm *vm) model4Decode(addr uint16) (region int, i int) {
+	mode := vm.model4Control & model4MapMask
+
+	switch {
+	case mode == 3, mode == 2 && addr < model4KeyboardBegin:
+		return model4Ram, int(addr) + vm.bankOffset[addr>>15]
+	case mode == 2 && addr >= model4VideoBegin:
+		return model4Video, int(addr - model4VideoBegin)
+	case mode == 2:
+		return model4Keyboard, int(addr - model4KeyboardBegin)
+	case addr >= ramBegin, mode == 1 && addr < keyboardBegin:
+		return model4Ram, int(addr) + vm.bankOffset[addr>>15]
+	case addr >= screenBegin:
+		page := 0
+		if vm.model4Control&model4VideoPage != 0 {
+			page = 1024
+		}
+		return model4Video, page + int(addr-screenBegin)
+	case addr >= keyboardBegin:
+		return model4Keyboard, int(addr - keyboardBegin)
+	case addr < vm.romSize:
+		return model4Rom, int(addr)
+	case addr == 0x37E8:
+		return model4Printer, 0
+	}
+
+	return model4Unmapped, 0
+}
+
+// Read a byte from the Model 4's memory.
+func (vm *vm) readModel4Mem(addr uint16) byte {
+	region, i := vm.model4Decode(addr)
+
+	switch region {
+	case model4Ram:
+		return vm.readRam(i)
+	case model4Rom:
+		return vm.rom[i]
+	case model4Keyboard:
+		// The keyboard is repeated through its 1K.
+		return vm.readKeyboard(keyboardBegin + uint16(i&0xFF))
+	case model4Video:
+		return vm.video[i]
+	case model4Printer:
+		// Printer selected, ready, with paper, not busy.
+		return 0x30
+	}
+
+	return floatingBus
+}
+
+// Write a byte to the Model 4's memory.
+func (vm *vm) writeModel4Mem(addr uint16, b byte, protectRom bool) {
+	region, i := vm.model4Decode(addr)
+
+	switch region {
+	case model4Ram:
+		vm.writeRam(i, b)
+	case model4Rom:
+		vm.writeRom(addr, b, protectRom)
+	case model4Video:
+		vm.writeVideo(i, b)
+	}
+}
+
+// Write to port 0x84: the memory map, the RAM banks, and the video mode.
+func (vm *vm) writeModel4Control(value byte) {
+	vm.model4Control = value
+
+	// Each 32K half of the address space normally maps to the same half of
+	// the first 64K of RAM. One of them can be switched to bank 2 or 3, in
+	// the second 64K.
+	vm.bankOffset = [2]int{0, 0}
+	if value&model4BankSwitch != 0 {
+		bank := 2
+		if value&model4Bank3 != 0 {
+			bank = 3
+		}
+		if value&model4BankLower != 0 {
+			vm.bankOffset[0] = bank * 0x8000
+		} else {
+			vm.bankOffset[1] = (bank - 1) * 0x8000
+		}
+	}
+
+	if value&model4Video80 != 0 {
+		vm.setScreenSize(80, 24)
+	} else {
+		vm.setScreenSize(64, 16)
+	}
+	vm.setInverseVideo(value&model4Inverse != 0)
+}
+
+// Switch the CPU between normal and double speed.
+func (vm *vm) setFastCpu(fastCpu bool) {
+	if fastCpu != vm.fastCpu {
+		vm.fastCpu = fastCpu
+		log.Printf("CPU running at %.2f MHz", float64(vm.cpuHz())/1000000)
+		vm.resetThrottle()
+	}
+}
@@ -17,6 +17,11 @@ var ports = map[byte]string{
 	0x85: "Model IV video page",
 	0x86: "Model IV video page",
 	0x87: "Model IV video page",
+	0x88: "Model IV CRTC",
+	0x89: "Model IV CRTC",
+	0x8A: "Model IV CRTC",
+	0x8B: "Model IV CRTC",
+	0x90: "Model IV sound",
 	0xE0: "maskable interrupt",
 	0xE4: "NMI options/status",
 	0xE5: "NMI options/status",
@@ -51,6 +56,10 @@ var ports = map[byte]string{
 // Read a byte from a port.
 func (vm *vm) readPort(port byte) byte {
 	/// log.Printf("Reading port %02X", port)
+	if vm.machine.model == model1 {
+		return vm.readModel1Port(port)
+	}
+
 	switch port {
 	case 0x00:
 		// Joystick.
@@ -108,9 +117,21 @@ func (vm *vm) readPort(port byte) byte {
 // Write a byte to a port.
 func (vm *vm) writePort(port byte, value byte) {
 	/// log.Printf("Writing %02X to port %02X", value, port)
+	if vm.machine.model == model1 {
+		vm.writeModel1Port(port, value)
+		return
+	}
+
 	switch port {
 	case 0x84, 0x85, 0x86, 0x87:
-		// Model 4 video page, etc. Ignore.
+		// Model 4 memory map, video page, etc.
+		if vm.machine.model == model4 {
+			vm.writeModel4Control(value)
+		}
+	case 0x88, 0x89, 0x8A, 0x8B:
+		// Model 4 video controller. Its registers are only set at boot.
+	case 0x90:
+		// Model 4 sound. Ignore.
 	case 0x1F:
 		// Don't know. Don't crash.
 	case 0xE0:
@@ -132,6 +153,9 @@ func (vm *vm) writePort(port byte, value byte) {
 		vm.modeImage = value
 		vm.setCassetteMotor(value&0x02 != 0)
 		vm.setExpandedCharacters(value&0x04 != 0)
+		if vm.machine.model == model4 {
+			vm.setFastCpu(value&model4FastCpu != 0)
+		}
 	case 0xF0:
 		// Disk command.
 		vm.writeDiskCommand(value)
@@ -164,28 +188,63 @@ func (vm *vm) writePort(port byte, value byte) {
 	}
 }
 
+// Read a byte from a port on the Model I. Only the cassette port is decoded.
+func (vm *vm) readModel1Port(port byte) byte {
+	if port == 0xFF {
+		// The cassette owns bit 7. The rest float.
+		return 0x7F | (vm.getCassetteByte() & 0x80)
+	}
+
+	return 0xFF
+}
+
+// Write a byte to a port on the Model I. Only the cassette port is decoded.
+func (vm *vm) writeModel1Port(port byte, value byte) {
+	if port == 0xFF {
+		vm.putCassetteByte(value & 0x03)
+		vm.setCassetteMotor(value&0x04 != 0)
+		vm.setExpandedCharacters(value&0x08 != 0)
+	}
+}
+
 // The rest of the file is to satisfy the z80.PortAccessor interface, which the
 // z80 uses.
 func (vm *vm) ReadPort(address uint16) byte {
-	return vm.ReadPortInternal(address, false)
+	return vm.ReadPortInternal(address, true)
 }
 
 func (vm *vm) WritePort(address uint16, b byte) {
-	vm.WritePortInternal(address, b, false)
+	vm.WritePortInternal(address, b, true)
 }
 
 func (vm *vm) ReadPortInternal(address uint16, contend bool) byte {
-	return vm.readPort(byte(address))
+	if contend {
+		vm.ContendPortPreio(address)
+	}
+	b := vm.readPort(byte(address))
+	if contend {
+		vm.ContendPortPostio(address)
+	}
+
+	return b
 }
 
 func (vm *vm) WritePortInternal(address uint16, b byte, contend bool) {
+	if contend {
+		vm.ContendPortPreio(address)
+	}
 	vm.writePort(byte(address), b)
+	if contend {
+		vm.ContendPortPostio(address)
+	}
 }
 
+// An I/O cycle takes four T-states: one before the port is read or written,
+// and three after (including the wait state the Z80 inserts).
 func (vm *vm) ContendPortPreio(address uint16) {
-	// Ignore.
+	vm.clock++
 }
 
 func (vm *vm) ContendPortPostio(address uint16) {
-	// Ignore.
+	vm.clock += 3
 }
@@ -0,0 +1,73 @@
+// Copyright 2012 Lawrence Kesteloot
+
+package main
+
+// Loading and identifying ROM images.
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+)
+
+// ROM images we know, by their CRC-32: the ones in the "roms" directory.
+// Other images, including other revisions of these ROMs, are logged as
+// unknown along with their CRC-32, which tells the revisions apart.
+var knownRoms = map[uint32]string{
+	0x70D06DFF: "Model I Level I BASIC",
+	0x0D8A132E: "Model I Level II BASIC",
+	0xBDDBF843: "Model III BASIC",
+}
+
+// Return the pathname of the machine's ROM, given by the -rom flag or found
+// in the -roms directory.
+func romPathname(m *machine) string {
+	if *romFile != "" {
+		return *romFile
+	}
+
+	return path.Join(*romsDir, m.romFilename)
+}
+
+// Return a description of a ROM image, or the empty string if we don't know
+// it.
+func identifyRom(rom []byte) string {
+	return knownRoms[crc32.ChecksumIEEE(rom)]
+}
+
+// Load and identify the machine's ROM. Images larger than the machine's ROM
+// (such as ones padded to the size of a chip) are cut down to size, and
+// smaller ones leave the rest of the ROM space unmapped.
+func loadRom(m *machine) ([]byte, error) {
+	pathname := romPathname(m)
+	rom, err := ioutil.ReadFile(pathname)
+	if os.IsNotExist(err) && *romFile == "" {
+		// Not all ROMs are included.
+		return nil, fmt.Errorf("Can't find ROM \"%s\": put the %s ROM there, or give its file with -rom",
+			pathname, m.name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Can't load ROM: %s", err)
+	}
+	if len(rom) == 0 {
+		return nil, fmt.Errorf("ROM \"%s\" is empty", pathname)
+	}
+
+	name := identifyRom(rom)
+	if len(rom) > m.romSize {
+		log.Printf("ROM \"%s\" has %d bytes, using the first %d", pathname, len(rom), m.romSize)
+		rom = rom[:m.romSize]
+		if name == "" {
+			name = identifyRom(rom)
+		}
+	}
+	if name == "" {
+		name = "unknown ROM"
+	}
+	log.Printf("ROM \"%s\" is %s (CRC-32 %08X)", pathname, name, crc32.ChecksumIEEE(rom))
+
+	return rom, nil
+}
@@ -11,6 +11,17 @@ const (
 	screenEnd     = screenBegin + screenRows*screenColumns
 )
 
+// The Model I's video memory has no bit 6. The hardware makes it up from
+// bits 5 and 7, so that only uppercase letters, digits, punctuation, and
+// graphics can be shown.
+func model1VideoByte(b byte) byte {
+	if b&0xA0 == 0 {
+		return b | 0x40
+	}
+
+	return b &^ 0x40
+}
+
 func (vm *vm) setExpandedCharacters(expanded bool) {
 	if vm.vmUpdateCh != nil {
 		value := 0
@@ -21,3 +32,54 @@ func (vm *vm) setExpandedCharacters(expanded bool) {
 		vm.vmUpdateCh <- vmUpdate{Cmd: "expanded", Data: value}
 	}
 }
+
+// Write a byte to video memory and show it.
+func (vm *vm) writeVideo(i int, b byte) {
+	vm.video[i] = b
+	vm.updateScreenChar(i)
+}
+
+// Send a character of video memory to the UI, if it's on the screen. The
+// UI still addresses the screen as if it started at screenBegin.
+func (vm *vm) updateScreenChar(i int) {
+	if vm.vmUpdateCh != nil && i < vm.screenWidth*vm.screenHeight {
+		vm.vmUpdateCh <- vmUpdate{Cmd: "poke", Addr: screenBegin + i, Msg: string(vm.screenChar(vm.video[i]))}
+	}
+}
+
+// Return the character to show for a byte of video memory. Inverse
+// characters are sent as 256 plus the normal character.
+func (vm *vm) screenChar(b byte) rune {
+	if vm.inverseVideo && b >= 0x80 {
+		return 0x100 + rune(b&0x7F)
+	}
+
+	return rune(b)
+}
+
+// Send the whole screen to the UI.
+func (vm *vm) redrawScreen() {
+	for i := 0; i < vm.screenWidth*vm.screenHeight; i++ {
+		vm.updateScreenChar(i)
+	}
+}
+
+// Change the number of characters on the screen.
+func (vm *vm) setScreenSize(width, height int) {
+	if width != vm.screenWidth || height != vm.screenHeight {
+		vm.screenWidth = width
+		vm.screenHeight = height
+		if vm.vmUpdateCh != nil {
+			vm.vmUpdateCh <- vmUpdate{Cmd: "screen_size", Addr: width, Data: height}
+		}
+		vm.redrawScreen()
+	}
+}
+
+// Choose whether characters 0x80 to 0xFF are inverse video or graphics.
+func (vm *vm) setInverseVideo(inverse bool) {
+	if inverse != vm.inverseVideo {
+		vm.inverseVideo = inverse
+		vm.redrawScreen()
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2012 Lawrence Kesteloot
+
+package main
+
+// Conditions the analog signal from a cassette before we look for pulses.
+// Tapes digitized from real recorders are often quiet, have a DC offset, or
+// are inverted, so we can't compare samples against a fixed threshold.
+//
+// We remove the DC offset by subtracting a slow running average, then follow
+// the envelope of the signal (its recent peak) and set the thresholds as a
+// fraction of it. A sample must go past the high threshold to become positive
+// or negative, and back inside the low threshold to become neutral again, so
+// that noise near a threshold doesn't make extra edges.
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	// Time constants, in seconds, of the DC offset average and of the decay
+	// of the envelope. Both are much longer than a bit.
+	cassetteDcTime       = 0.05
+	cassetteEnvelopeTime = 0.02
+
+	// Thresholds as a fraction of the envelope.
+	cassetteHighThreshold = 0.5
+	cassetteLowThreshold  = 0.25
+
+	// Smallest envelope, so that we don't decode the noise of silent parts
+	// of the tape.
+	cassetteMinEnvelope = 800
+
+	// Number of rising edges to look at to guess the baud rate.
+	cassetteLeaderRises = 64
+
+	// Edges closer than this (in seconds) are noise at any baud rate.
+	cassetteGlitchTime = 0.0002
+)
+
+// Turns samples into cassette values.
+type cassetteDecoder struct {
+	samplesPerSecond float64
+	invert           bool
+	dcAlpha          float64
+	envelopeDecay    float64
+
+	// Filter state.
+	sampleCount int
+	dcOffset    float64
+	envelope    float64
+	value       cassetteValue
+
+	// Statistics for the diagnostic report.
+	peak       float64 // Largest envelope.
+	noiseSum   float64 // Sum of absolute neutral samples.
+	noiseCount int
+	rises      []float64 // Times of the first positive edges, in seconds.
+	riseCount  int
+	lastRise   float64
+	glitches   int
+	baud       int  // Guessed from the leader, or 0 if not known yet.
+	baudFound  bool // Whether baud was guessed since leaderFound() was called.
+}
+
+// Make a decoder for samples at the given rate.
+func newCassetteDecoder(samplesPerSecond uint32, invert bool) *cassetteDecoder {
+	rate := float64(samplesPerSecond)
+
+	return &cassetteDecoder{
+		samplesPerSecond: rate,
+		invert:           invert,
+		dcAlpha:          1 - math.Exp(-1/(cassetteDcTime*rate)),
+		envelopeDecay:    math.Exp(-1 / (cassetteEnvelopeTime * rate)),
+		envelope:         cassetteMinEnvelope,
+	}
+}
+
+// Convert the next sample to a value.
+func (d *cassetteDecoder) decode(s int16) cassetteValue {
+	x := float64(s)
+	if d.invert {
+		x = -x
+	}
+
+	// Remove DC offset. Start from the first sample so that we don't see
+	// an edge while the average catches up.
+	if d.sampleCount == 0 {
+		d.dcOffset = x
+	} else {
+		d.dcOffset += (x - d.dcOffset) * d.dcAlpha
+	}
+	x -= d.dcOffset
+	d.sampleCount++
+
+	// Follow the envelope: jump up to peaks, decay slowly.
+	d.envelope *= d.envelopeDecay
+	if math.Abs(x) > d.envelope {
+		d.envelope = math.Abs(x)
+	}
+	if d.envelope < cassetteMinEnvelope {
+		d.envelope = cassetteMinEnvelope
+	}
+	if d.envelope > d.peak {
+		d.peak = d.envelope
+	}
+
+	// Compare with hysteresis.
+	high := d.envelope * cassetteHighThreshold
+	low := d.envelope * cassetteLowThreshold
+	value := d.value
+	if x > high {
+		value = cassettePositive
+	} else if x < -high {
+		value = cassetteNegative
+	} else if math.Abs(x) < low {
+		value = cassetteNeutral
+	}
+
+	if value == cassetteNeutral {
+		d.noiseSum += math.Abs(x)
+		d.noiseCount++
+	}
+	if value == cassettePositive && d.value != cassettePositive {
+		d.addRise(float64(d.sampleCount) / d.samplesPerSecond)
+	}
+	d.value = value
+
+	return value
+}
+
+// Keep track of a positive edge at the given time.
+func (d *cassetteDecoder) addRise(t float64) {
+	if d.riseCount > 0 && t-d.lastRise < cassetteGlitchTime {
+		d.glitches++
+	}
+	d.riseCount++
+	d.lastRise = t
+
+	if len(d.rises) < cassetteLeaderRises {
+		d.rises = append(d.rises, t)
+		if len(d.rises) == cassetteLeaderRises {
+			d.baud = guessCasBaud(d.rises)
+			d.baudFound = d.baud != 0
+		}
+	}
+}
+
+// Whether we've learned the baud rate from the leader since the last call.
+// This is only true once per decoder.
+func (d *cassetteDecoder) leaderFound() bool {
+	found := d.baudFound
+	d.baudFound = false
+	return found
+}
+
+// Describe the signal so far, for the diagnostic mode.
+func (d *cassetteDecoder) report() string {
+	baud := "unknown baud"
+	if d.baud != 0 {
+		baud = fmt.Sprintf("%d baud", d.baud)
+	}
+
+	noise := 0.0
+	if d.noiseCount > 0 {
+		noise = d.noiseSum / float64(d.noiseCount)
+	}
+	snr := "n/a"
+	if noise > 0 {
+		snr = fmt.Sprintf("%.0f dB", 20*math.Log10(d.peak/noise))
+	}
+
+	return fmt.Sprintf("Cassette: %s, peak %.0f%%, DC offset %.0f, noise %.0f, S/N %s, %d edges, %d glitches",
+		baud, 100*d.peak/32768, d.dcOffset, noise, snr, d.riseCount, d.glitches)
+}
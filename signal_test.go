@@ -0,0 +1,35 @@
+// Copyright 2012 Lawrence Kesteloot
+
+package main
+
+import (
+	"testing"
+)
+
+// The diagnostic report is shown when the leader has been found, so that
+// must only happen once per tape.
+func TestLeaderFoundOnce(t *testing.T) {
+	// A leader, the sync byte, and some data.
+	data := append(make([]byte, 2*cassetteLeaderRises), casLowSpeedSync, 0x12, 0x34)
+	cas := &casFile{data: data, baud: 500}
+	decoder := newCassetteDecoder(cas.sampleRate(), false)
+
+	found := 0
+	for {
+		s, err := cas.readSample()
+		if err != nil {
+			break
+		}
+		decoder.decode(s)
+		if decoder.leaderFound() {
+			found++
+		}
+	}
+
+	if found != 1 {
+		t.Errorf("Found the leader %d times, expected once", found)
+	}
+	if decoder.baud != 500 {
+		t.Errorf("Guessed %d baud, expected 500", decoder.baud)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2012 Lawrence Kesteloot
+
+package main
+
+// Control of the emulator's speed. It normally runs as fast as the real
+// machine, but can run at a multiple of that, as fast as it can, or not at
+// all. With auto-turbo it runs as fast as it can while a disk or cassette
+// motor is running, like sdltrs.
+
+import (
+	"fmt"
+	"time"
+)
+
+// Run as fast as we can.
+const unlimitedSpeed = 0
+
+// Speeds we can run at, as multiples of the real machine's.
+var speeds = []int{1, 2, 4, unlimitedSpeed}
+
+// Return an error if we can't run at this speed.
+func checkSpeed(speed int) error {
+	for _, s := range speeds {
+		if s == speed {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Can't run at speed %d (must be 1, 2, 4, or 0 for unlimited)", speed)
+}
+
+// Set the speed, as a multiple of the real machine's.
+func (vm *vm) setSpeed(speed int) error {
+	err := checkSpeed(speed)
+	if err != nil {
+		return err
+	}
+
+	vm.speed = speed
+	vm.updateSpeedSettings()
+	return nil
+}
+
+// Turn auto-turbo on or off.
+func (vm *vm) setAutoTurbo(autoTurbo bool) {
+	vm.autoTurbo = autoTurbo
+	vm.updateSpeedSettings()
+}
+
+// Return the speed to run at now, or unlimitedSpeed.
+func (vm *vm) throttleSpeed() int {
+	if vm.autoTurbo && (vm.fdc.motorOn || vm.cc.motorOn) {
+		return unlimitedSpeed
+	}
+
+	return vm.speed
+}
+
+// Stop or resume running.
+func (vm *vm) setPaused(paused bool) {
+	if paused != vm.paused {
+		vm.paused = paused
+		if !paused {
+			// Don't try to make up for the time we were paused.
+			vm.resetThrottle()
+			vm.previousDumpTime = time.Now()
+			vm.previousDumpClock = vm.clock
+		}
+		vm.updatePaused()
+	}
+}
+
+// Keep real time in step with the clock from here on.
+func (vm *vm) resetThrottle() {
+	vm.startTime = time.Now().UnixNano()
+	vm.startClock = vm.clock
+}
+
+// Send the speed and auto-turbo settings to the UI.
+func (vm *vm) updateSpeedSettings() {
+	if vm.vmUpdateCh != nil {
+		autoTurbo := 0
+		if vm.autoTurbo {
+			autoTurbo = 1
+		}
+
+		vm.vmUpdateCh <- vmUpdate{Cmd: "speed_settings", Addr: vm.speed, Data: autoTurbo}
+	}
+}
+
+// Tell the UI whether we're paused.
+func (vm *vm) updatePaused() {
+	if vm.vmUpdateCh != nil {
+		paused := 0
+		if vm.paused {
+			paused = 1
+		}
+
+		vm.vmUpdateCh <- vmUpdate{Cmd: "paused", Data: paused}
+	}
+}
+
+// Send the measured speed to the UI, as a multiple of the real machine's.
+func (vm *vm) updateActualSpeed(mult float64) {
+	if vm.vmUpdateCh != nil {
+		vm.vmUpdateCh <- vmUpdate{Cmd: "speed", Msg: fmt.Sprintf("%.1fx", mult)}
+	}
+}
@@ -5,6 +5,16 @@
     var g_ws = null;
     // Which floppy drive motors are on.
     var g_motor_on = [false, false, false, false];
+    // Functions to refill the file selectors, by input name.
+    var g_fill_selector = {};
+    // Position of the cassette tape and start of its blocks, in milliseconds.
+    var g_cassette_position = 0;
+    var g_cassette_blocks = [];
+    // Size of the screen in characters.
+    var g_screen_width = 64;
+    var g_screen_height = 16;
+    // Whether the emulator is paused.
+    var g_paused = false;
 
     // Set up the DOM for the screen, which is an array of spans of fixed size with the
     // same background (font.png). We move the background around for each cell to show
@@ -12,10 +22,11 @@
     // paste the text.
     var createScreen = function () {
         var $screen = $("div.screen");
+        $screen.empty();
 
         var addr = 15360;
-        for (var y = 0; y < 16; y++) {
-            for (var x = 0; x < 64; x++) {
+        for (var y = 0; y < g_screen_height; y++) {
+            for (var x = 0; x < g_screen_width; x++) {
                 var $ch = $("<span>").attr("id", "s" + addr).addClass("char");
                 if (x % 2 === 0) {
                     $ch.addClass("even-column");
@@ -48,6 +59,27 @@
             }
         });
 
+        // Speed controls.
+        $("#pauseButton").click(function () {
+            if (g_ws) {
+                g_ws.send(JSON.stringify({Cmd: g_paused ? "resume" : "pause"}));
+                $(this).blur();
+            }
+        });
+        $("#speed").change(function () {
+            if (g_ws) {
+                g_ws.send(JSON.stringify({Cmd: "set_speed", Addr: parseInt($(this).val(), 10)}));
+                $(this).blur();
+            }
+        });
+        $("#autoTurbo").change(function () {
+            if (g_ws) {
+                g_ws.send(JSON.stringify({Cmd: "set_autoturbo",
+                    Data: $(this).prop("checked") ? "true" : "false"}));
+                $(this).blur();
+            }
+        });
+
         if (SHOW_DEBUG) {
             $(".debug-panel").show();
         }
@@ -69,31 +101,41 @@
         });
 
         // Configure the control where the user can specify diskettes and cassette.
-        var configureInputSelector = function (input, file_type) {
+        // The command is sent with the filename and the drive, if any.
+        var configureInputSelector = function (input, file_type, command, drive) {
             var $select = $("#" + input);
 
-            // Fill the <select>
-            $.ajax({
-                url: "/" + file_type + ".json",
-                dataType: "json",
-                success: function (filenames) {
-                    $select.empty();
-                    $select.append(
-                        $("<option>").
-                            text("-- empty --"));
-                    for (var i = 0; i < filenames.length; i++) {
+            // Fill the <select>, keeping the selection or selecting the
+            // given filename.
+            var fillSelector = function (selected) {
+                if (selected === undefined) {
+                    selected = $select.find("option:selected").text();
+                }
+                $.ajax({
+                    url: "/" + file_type + ".json",
+                    dataType: "json",
+                    success: function (filenames) {
+                        $select.empty();
+                        $select.append(
+                            $("<option>").
+                                text("-- empty --"));
+                        for (var i = 0; i < filenames.length; i++) {
+                            $select.append(
+                                $("<option>").
+                                    text(filenames[i]).
+                                    prop("selected", filenames[i] === selected));
+                        }
+                    },
+                    error: function () {
+                        $select.empty();
                         $select.append(
                             $("<option>").
-                                text(filenames[i]));
+                                text("-- invalid directory --"));
                     }
-                },
-                error: function () {
-                    $select.empty();
-                    $select.append(
-                        $("<option>").
-                            text("-- invalid directory --"));
-                }
-            });
+                });
+            };
+            fillSelector();
+            g_fill_selector[input] = fillSelector;
 
             // Update VM when input changes.
             var setInput = function () {
@@ -103,7 +145,7 @@
                 }
 
                 if (g_ws) {
-                    g_ws.send(JSON.stringify({Cmd: "set_" + input, Data: filename}));
+                    g_ws.send(JSON.stringify({Cmd: command, Addr: drive, Data: filename}));
                 }
 
                 // Blur the selector so that subsequent keystrokes (for the emulator)
@@ -115,9 +157,97 @@
             $select.change(setInput);
         };
 
-        configureInputSelector("disk0", "disks");
-        configureInputSelector("disk1", "disks");
-        configureInputSelector("cassette", "cassettes");
+        for (var drive = 0; drive < 4; drive++) {
+            configureInputSelector("disk" + drive, "disks", "set_disk", drive);
+        }
+        configureInputSelector("cassette", "cassettes", "set_cassette");
+
+        // Configure the write-protect checkbox of a drive.
+        var configureWriteProtect = function (drive) {
+            var $checkbox = $("#writeProtect" + drive);
+
+            $checkbox.change(function () {
+                if (g_ws) {
+                    g_ws.send(JSON.stringify({Cmd: "set_write_protect", Addr: drive,
+                        Data: $checkbox.is(":checked") ? "true" : "false"}));
+                }
+
+                // The emulator tells us whether it worked.
+                $checkbox.blur();
+            });
+        };
+
+        for (drive = 0; drive < 4; drive++) {
+            configureWriteProtect(drive);
+        }
+
+        // Configure the buttons that deal with changes to a drive's diskette
+        // when it's an overlay.
+        var configureDiskButtons = function (drive) {
+            $("#diskSaveAs" + drive).click(function () {
+                var filename = window.prompt("Save diskette in drive " + drive + " as:");
+                if (filename && g_ws) {
+                    g_ws.send(JSON.stringify({Cmd: "disk_save_as", Addr: drive, Data: filename}));
+                }
+                $(this).blur();
+            });
+            $("#diskCommit" + drive).click(function () {
+                if (g_ws) {
+                    g_ws.send(JSON.stringify({Cmd: "disk_commit", Addr: drive}));
+                }
+                $(this).blur();
+            });
+            $("#diskDiscard" + drive).click(function () {
+                if (g_ws) {
+                    g_ws.send(JSON.stringify({Cmd: "disk_discard", Addr: drive}));
+                }
+                $(this).blur();
+            });
+        };
+
+        for (drive = 0; drive < 4; drive++) {
+            configureDiskButtons(drive);
+        }
+
+        // Configure the tape transport.
+        var seekCassette = function (position) {
+            if (g_ws) {
+                g_ws.send(JSON.stringify({Cmd: "cassette_seek", Addr: position}));
+            }
+        };
+        $("#cassetteRewind").click(function () {
+            seekCassette(0);
+            $(this).blur();
+        });
+        $("#cassetteNext").click(function () {
+            // Wind to the next block, skipping the one we're in.
+            for (var i = 0; i < g_cassette_blocks.length; i++) {
+                if (g_cassette_blocks[i] > g_cassette_position + 1000) {
+                    seekCassette(g_cassette_blocks[i]);
+                    break;
+                }
+            }
+            $(this).blur();
+        });
+        $("#cassetteEject").click(function () {
+            $("#cassette").val("-- empty --").change();
+            $(this).blur();
+        });
+        $("#cassetteBlocks").change(function () {
+            var position = $(this).val();
+            if (position !== "") {
+                seekCassette(parseInt(position, 10));
+            }
+            $(this).val("").blur();
+        });
+    };
+
+    // Format a position on the tape, in milliseconds, as minutes and seconds.
+    var formatTapePosition = function (position) {
+        var seconds = Math.floor(position / 1000);
+        var minutes = Math.floor(seconds / 60);
+        seconds -= minutes * 60;
+        return minutes + ":" + (seconds < 10 ? "0" : "") + seconds;
     };
 
     // Handle a command from the emulator.
@@ -131,11 +261,14 @@
             for (var i = 0; i < update.Msg.length; i++) {
                 var data = update.Msg.charCodeAt(i);
 
-                if (addr >= 15360 && addr < 16384) {
-                    // Screen.
+                if (addr >= 15360 && addr < 15360 + g_screen_width*g_screen_height) {
+                    // Screen. Inverse characters come as 256 plus the character.
                     var $s = $("#s" + addr);
                     var cls = $s.attr("class");
-                    var newCls = "char char-" + data;
+                    var newCls = "char char-" + (data & 0xFF);
+                    if (data >= 256) {
+                        newCls += " inverse";
+                    }
 
                     // Retain the odd/even columns. Could recompute this from
                     // the address too.
@@ -177,12 +310,62 @@
                     $(".floppies-off").show();
                 }
             }
+        } else if (cmd === "write_protect") {
+            // Show whether the diskette is write-protected.
+            $("#writeProtect" + update.Addr).prop("checked", update.Data != 0);
+        } else if (cmd === "disk_overlay") {
+            // Only overlays have changes to commit, discard, or save.
+            $("#diskButtons" + update.Addr).toggle(update.Data != 0);
+        } else if (cmd === "disk_saved") {
+            // The diskette was saved to a new file. Add it to the lists.
+            $("#message").text("Saved drive " + update.Addr + " as " + update.Msg);
+            for (var drive = 0; drive < 4; drive++) {
+                g_fill_selector["disk" + drive](update.Addr === drive ? update.Msg : undefined);
+            }
+        } else if (cmd === "cassette_saved") {
+            // The program saved something to tape. Add it to the list.
+            $("#message").text("Recorded cassette " + update.Msg);
+            g_fill_selector["cassette"]();
+        } else if (cmd === "cassette_position") {
+            // The tape moved.
+            g_cassette_position = update.Data;
+            $("#cassettePosition").text(formatTapePosition(update.Data));
+        } else if (cmd === "cassette_blocks") {
+            // The list of blocks follows.
+            g_cassette_blocks = [];
+            $("#cassetteBlocks").empty().append(
+                $("<option>").
+                    val("").
+                    text(update.Data > 0 ? "-- jump to --" : "-- no blocks --"));
+        } else if (cmd === "cassette_block") {
+            // A block on the tape and its position.
+            g_cassette_blocks.push(update.Data);
+            $("#cassetteBlocks").append(
+                $("<option>").
+                    val(update.Data).
+                    text(formatTapePosition(update.Data) + " " + update.Msg));
         } else if (cmd === "breakpoint") {
             // We've hit a breakpoint. This could just be a message.
             $("#message").text("Breakpoint at 0x" + update.Addr.toString(16))
+        } else if (cmd === "speed_settings") {
+            // The speed multiplier (0 for unlimited) and auto-turbo.
+            $("#speed").val(update.Addr);
+            $("#autoTurbo").prop("checked", update.Data != 0);
+        } else if (cmd === "paused") {
+            g_paused = update.Data != 0;
+            $("#pauseButton").text(g_paused ? "Resume" : "Pause");
+            $("#actualSpeed").text(g_paused ? "Paused" : "");
+        } else if (cmd === "speed") {
+            // How fast we're actually running, compared to the real machine.
+            $("#actualSpeed").text(update.Msg);
         } else if (cmd === "message") {
             // Show a generic message.
             $("#message").text(update.Msg);
+        } else if (cmd === "screen_size") {
+            // Switch between 64x16 and 80x24. The characters will follow.
+            g_screen_width = update.Addr;
+            g_screen_height = update.Data;
+            createScreen();
         } else if (cmd === "expanded") {
             // Expanded character font.
             if (update.Data !== 0) {
@@ -18,8 +18,11 @@ func (vm *vm) step() {
 		vm.historicalPc[vm.historicalPcPtr] = vm.z80.PC()
 	}
 
+	// The z80 counts the T-states of acknowledging interrupts itself.
+	tstates := vm.z80.Tstates
+
 	// Execute a single instruction.
-	vm.z80.DoOpcode()
+	vm.runInstruction()
 
 	// Dispatch scheduled events.
 	vm.events.dispatch(vm.clock)
@@ -43,18 +46,21 @@ func (vm *vm) step() {
 		}
 		vm.z80.Interrupt()
 	}
+	vm.addZ80Tstates(tstates)
 
 	// Print something periodically.
-	if vm.clock > vm.previousDumpClock+cpuHz {
+	if vm.clock > vm.previousDumpClock+vm.cpuHz() {
 		now := time.Now()
 		if vm.previousDumpClock > 0 {
 			elapsed := now.Sub(vm.previousDumpTime)
-			computerTime := float64(vm.clock-vm.previousDumpClock) / float64(cpuHz)
+			computerTime := float64(vm.clock-vm.previousDumpClock) / float64(vm.cpuHz())
+			mult := computerTime / elapsed.Seconds()
 			log.Printf("Computer time: %.1fs, elapsed: %.1fs, mult: %.1f, slept: %dms (%d,%d)",
-				computerTime, elapsed.Seconds(), computerTime/elapsed.Seconds(),
+				computerTime, elapsed.Seconds(), mult,
 				vm.sleptSinceDump/time.Millisecond,
 				vm.cassetteRiseInterruptCount,
 				vm.cassetteFallInterruptCount)
+			vm.updateActualSpeed(mult)
 			vm.sleptSinceDump = 0
 			vm.cassetteRiseInterruptCount = 0
 			vm.cassetteFallInterruptCount = 0
@@ -64,11 +70,21 @@ func (vm *vm) step() {
 	}
 
 	// Slow down CPU if we're going too fast.
-	if !goFullSpeed && !*profiling && vm.clock > vm.previousAdjustClock+1000 {
-		now := time.Now().UnixNano()
-		elapsedReal := time.Duration(now - vm.startTime)
-		elapsedFake := time.Duration(vm.clock * cpuPeriodNs)
-		aheadNs := elapsedFake - elapsedReal
+	if !*profiling && vm.clock > vm.previousAdjustClock+1000 {
+		speed := vm.throttleSpeed()
+		if speed != vm.previousSpeed {
+			// Don't make up for time spent at the other speed.
+			vm.resetThrottle()
+			vm.previousSpeed = speed
+		}
+
+		var aheadNs time.Duration
+		if speed != unlimitedSpeed {
+			now := time.Now().UnixNano()
+			elapsedReal := time.Duration(now - vm.startTime)
+			elapsedFake := time.Duration((vm.clock - vm.startClock) * vm.cpuPeriodNs() / uint64(speed))
+			aheadNs = elapsedFake - elapsedReal
+		}
 		if aheadNs > 0 {
 			time.Sleep(aheadNs)
 			vm.sleptSinceDump += aheadNs
@@ -81,7 +97,7 @@ func (vm *vm) step() {
 	}
 
 	// Set off a timer interrupt.
-	if vm.clock > vm.previousTimerClock+timerCycles {
+	if vm.clock > vm.previousTimerClock+vm.timerCycles() {
 		vm.handleTimer()
 		vm.previousTimerClock = vm.clock
 	}
@@ -89,3 +105,18 @@ func (vm *vm) step() {
 	// Update cassette state.
 	vm.updateCassette()
 }
+
+// Execute a single instruction, unless we run its routine ourselves.
+func (vm *vm) runInstruction() {
+	hook := vm.pcHook()
+	if hook == nil || !hook(vm) {
+		vm.z80.DoOpcode()
+	}
+}
+
+// Add to our clock the T-states that the z80 counted itself since it had
+// counted the given number. Everything else goes through the memory and port
+// accessors.
+func (vm *vm) addZ80Tstates(tstates int) {
+	vm.clock += uint64(vm.z80.Tstates - tstates)
+}
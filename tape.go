@@ -0,0 +1,345 @@
+// Copyright 2012 Lawrence Kesteloot
+
+package main
+
+// The bytes on a cassette, decoded up front. We use them to fast-load
+// programs and to list the programs on the tape, so that the user can jump
+// to one of them.
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"sort"
+	"strings"
+)
+
+const (
+	// Silence (in seconds) between pulses that separates two recordings on
+	// a tape. Much longer than a bit at any speed.
+	tapeGapTime = 0.05
+
+	// Fewest leader bytes before a sync byte for us to consider it the start
+	// of a block, unless it's at the start of a recording.
+	tapeMinLeader = 8
+
+	// Bytes that mark the parts of BASIC and SYSTEM blocks.
+	tapeBasicHeader  = 0xD3 // Three of them, then the name.
+	tapeSystemHeader = 0x55 // Followed by the name.
+	tapeSystemData   = 0x3C // Followed by length, address, data, checksum.
+	tapeSystemEntry  = 0x78 // Followed by the entry address.
+)
+
+// The bytes of a tape.
+type cassetteTape struct {
+	data       []byte
+	times      []float64 // When each byte starts on the tape, in seconds.
+	end        float64   // When the last byte ends, in seconds.
+	recordings []int     // Index in data of the start of each recording.
+	blocks     []tapeBlock
+}
+
+// A program or data file on the tape.
+type tapeBlock struct {
+	// Index in the tape's data of the sync byte.
+	sync int
+
+	// When its leader starts, in seconds.
+	time float64
+
+	// Description, such as BASIC "A".
+	name string
+}
+
+// The result of decoding a tape in the background.
+type tapeDecoding struct {
+	tape *cassetteTape
+	err  error
+}
+
+// Decode the whole WAV or CAS file into bytes. Low-speed CAS files are
+// assumed to be at the given baud rate.
+func decodeTape(pathname string, lowSpeedBaud int) (*cassetteTape, error) {
+	cassette, err := openCassetteFile(pathname, lowSpeedBaud)
+	if err != nil {
+		return nil, err
+	}
+	defer cassette.close()
+
+	tape := &cassetteTape{}
+
+	if cas, ok := cassette.(*casFile); ok {
+		// Already have the bytes.
+		tape.data = cas.data
+		tape.times, tape.end = casByteTimes(cas.data, cas.baud)
+		tape.recordings = []int{0}
+	} else {
+		err = tape.decodeSamples(cassette)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tape.findBlocks()
+
+	log.Printf("Decoded %d bytes in %d blocks from cassette \"%s\"", len(tape.data), len(tape.blocks), pathname)
+
+	return tape, nil
+}
+
+// Find the pulses the way the analog emulation would and decode them. Each
+// recording on the tape is decoded separately because the silence between
+// them throws off the alignment of the bytes.
+func (tape *cassetteTape) decodeSamples(cassette cassetteReader) error {
+	sampleRate := float64(cassette.sampleRate())
+	decoder := newCassetteDecoder(cassette.sampleRate(), *invertCassette)
+	var rises []float64
+	var lastFall float64
+	previous := cassetteNeutral
+	for sampleCount := 0; ; sampleCount++ {
+		s, err := cassette.readSample()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		t := float64(sampleCount) / sampleRate
+		value := decoder.decode(s)
+		if value == cassettePositive && previous != cassettePositive {
+			if len(rises) > 0 && t-rises[len(rises)-1] > tapeGapTime {
+				tape.addRecording(rises, lastFall)
+				rises = nil
+			}
+			rises = append(rises, t)
+		}
+		if value != cassetteNegative && previous == cassetteNegative {
+			lastFall = t
+		}
+		previous = value
+	}
+	tape.addRecording(rises, lastFall)
+
+	return nil
+}
+
+// Decode the pulses of one recording and add its bytes to the tape.
+func (tape *cassetteTape) addRecording(rises []float64, end float64) {
+	// Ignore clicks in the silence.
+	if len(rises) < cassetteLeaderRises {
+		return
+	}
+
+	data, times := casBytes(decodeCasBits(rises, end))
+	tape.recordings = append(tape.recordings, len(tape.data))
+	tape.data = append(tape.data, data...)
+	tape.times = append(tape.times, times...)
+	tape.end = end
+}
+
+// Find the sync bytes that start blocks, and name the blocks. Programs and
+// data are full of bytes that look like sync bytes, so we only look for one
+// at the start of a recording or after the end of the previous block.
+func (tape *cassetteTape) findBlocks() {
+	speeds := []struct{ leader, sync byte }{
+		{casLowSpeedLeader, casLowSpeedSync},
+		{casHighSpeedLeader, casHighSpeedSync},
+	}
+
+	// Where we started looking for a sync byte, or -1 if we're in a block.
+	searchStart := -1
+
+	// Where the block we're in ends, or -1 if it goes to the end of the
+	// recording.
+	blockEnd := -1
+
+	recording := 0
+	for i, b := range tape.data {
+		for recording < len(tape.recordings) && tape.recordings[recording] <= i {
+			searchStart = i
+			recording++
+		}
+		if i == blockEnd {
+			searchStart = i
+		}
+		if searchStart == -1 {
+			continue
+		}
+
+		for _, speed := range speeds {
+			if b != speed.sync {
+				continue
+			}
+
+			// Walk back through the leader.
+			start := i
+			for start > searchStart && tape.data[start-1] == speed.leader {
+				start--
+			}
+			if start > searchStart && i-start < tapeMinLeader {
+				continue
+			}
+
+			tape.blocks = append(tape.blocks, tapeBlock{
+				sync: i,
+				time: tape.times[start],
+				name: tape.blockName(i),
+			})
+			searchStart = -1
+			blockEnd = tape.blockEnd(i)
+			break
+		}
+	}
+}
+
+// Return the index just past the end of the block whose sync byte is at the
+// given index, or -1 if we can't tell where it ends.
+func (tape *cassetteTape) blockEnd(sync int) int {
+	data := tape.data[sync+1:]
+
+	switch {
+	case isBasicBlock(data):
+		_, length, err := parseBasic(data[4:])
+		if err == nil {
+			return sync + 1 + 4 + length
+		}
+	case isSystemBlock(data):
+		if length := parseSystem(data).length; length != -1 {
+			return sync + 1 + length
+		}
+	}
+
+	return -1
+}
+
+// Describe the block whose sync byte is at the given index.
+func (tape *cassetteTape) blockName(sync int) string {
+	data := tape.data[sync+1:]
+
+	if isBasicBlock(data) {
+		return fmt.Sprintf("BASIC \"%s\"", printableChar(data[3]))
+	}
+	if isSystemBlock(data) {
+		return fmt.Sprintf("SYSTEM \"%s\"", strings.TrimSpace(string(data[1:7])))
+	}
+
+	return "Data"
+}
+
+// Return whether the bytes after a sync byte start a BASIC program: three
+// header bytes and a one-character name.
+func isBasicBlock(data []byte) bool {
+	return len(data) >= 4 && data[0] == tapeBasicHeader &&
+		data[1] == tapeBasicHeader && data[2] == tapeBasicHeader
+}
+
+// Return whether the bytes after a sync byte start a SYSTEM program: a
+// header byte and a six-character name.
+func isSystemBlock(data []byte) bool {
+	return len(data) >= 7 && data[0] == tapeSystemHeader
+}
+
+// A SYSTEM program: a name, blocks of data loaded at addresses, and the
+// address to start at.
+type systemProgram struct {
+	name       string
+	chunks     []systemChunk
+	entry      uint16
+	badChunks  int // Chunks whose checksum is wrong.
+	hasEntry   bool
+	parseError error
+
+	// Bytes of the program, or -1 if it runs off the end of the data.
+	length int
+}
+
+// Data loaded at an address.
+type systemChunk struct {
+	address uint16
+	data    []byte
+}
+
+// Parse a SYSTEM program from the bytes after the sync byte. Each chunk is a
+// 0x3C marker, a count (0 means 256), the address, the data, and a checksum
+// of the address and data. The program ends with a 0x78 marker and the entry
+// point.
+func parseSystem(data []byte) *systemProgram {
+	p := &systemProgram{length: -1}
+
+	if !isSystemBlock(data) {
+		p.parseError = fmt.Errorf("Not a SYSTEM program")
+		return p
+	}
+	p.name = strings.TrimSpace(string(data[1:7]))
+
+	i := 7
+	for i < len(data) {
+		switch data[i] {
+		case tapeSystemData:
+			if i+4 > len(data) {
+				p.parseError = fmt.Errorf("Chunk header is truncated")
+				return p
+			}
+			count := int(data[i+1])
+			if count == 0 {
+				count = 256
+			}
+			address := uint16(data[i+2]) | uint16(data[i+3])<<8
+			if i+4+count+1 > len(data) {
+				p.parseError = fmt.Errorf("Chunk at %04X is truncated", address)
+				return p
+			}
+			chunk := data[i+4 : i+4+count]
+
+			checksum := data[i+2] + data[i+3]
+			for _, b := range chunk {
+				checksum += b
+			}
+			if checksum != data[i+4+count] {
+				p.badChunks++
+			}
+
+			p.chunks = append(p.chunks, systemChunk{address, chunk})
+			i += 4 + count + 1
+		case tapeSystemEntry:
+			if i+3 > len(data) {
+				p.parseError = fmt.Errorf("Entry point is truncated")
+				return p
+			}
+			p.entry = uint16(data[i+1]) | uint16(data[i+2])<<8
+			p.hasEntry = true
+			p.length = i + 3
+			return p
+		default:
+			// Assume the program ends here.
+			p.parseError = fmt.Errorf("Unexpected byte %02X at offset %d", data[i], i)
+			p.length = i
+			return p
+		}
+	}
+
+	p.parseError = fmt.Errorf("Program has no entry point")
+	return p
+}
+
+// Return the first byte that starts at or after the given sample.
+func (tape *cassetteTape) byteAt(sample int, sampleRate uint32) int {
+	return sort.Search(len(tape.data), func(i int) bool {
+		return secondsToSamples(tape.times[i], sampleRate) >= sample
+	})
+}
+
+// Return when the given byte ends, in seconds.
+func (tape *cassetteTape) byteEnd(i int) float64 {
+	if i+1 < len(tape.times) {
+		return tape.times[i+1]
+	}
+
+	return tape.end
+}
+
+// Convert a time on the tape to a sample number.
+func secondsToSamples(t float64, sampleRate uint32) int {
+	return int(math.Floor(t*float64(sampleRate) + 0.5))
+}
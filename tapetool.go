@@ -0,0 +1,159 @@
+// Copyright 2012 Lawrence Kesteloot
+
+package main
+
+// The "tape" subcommand, which shows what's on a cassette without loading it
+// into the emulator:
+//
+//     trs80emu tape [-basic] [-cmd FILE] [-block N] [-level1] CASSETTE
+//
+// It lists the blocks on the tape, and can list BASIC programs or write
+// SYSTEM programs as /CMD files.
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Describe the program's load addresses, entry point, and checksums.
+func (p *systemProgram) String() string {
+	var parts []string
+
+	if len(p.chunks) > 0 {
+		low, high := 0xFFFF, 0
+		for _, chunk := range p.chunks {
+			if int(chunk.address) < low {
+				low = int(chunk.address)
+			}
+			if end := int(chunk.address) + len(chunk.data) - 1; end > high {
+				high = end
+			}
+		}
+		parts = append(parts, fmt.Sprintf("load %04X-%04X in %d chunks", low, high, len(p.chunks)))
+	}
+	if p.hasEntry {
+		parts = append(parts, fmt.Sprintf("entry %04X", p.entry))
+	}
+	if p.badChunks == 0 {
+		parts = append(parts, "checksums OK")
+	} else {
+		parts = append(parts, fmt.Sprintf("%d bad checksums", p.badChunks))
+	}
+	if p.parseError != nil {
+		parts = append(parts, p.parseError.Error())
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// Encode the program as a /CMD file: a header record with the name, a load
+// record for each chunk, and a transfer record with the entry point.
+func (p *systemProgram) cmdFile() []byte {
+	var b []byte
+
+	b = append(b, 0x05, 6)
+	b = append(b, fmt.Sprintf("%-6s", p.name)...)
+	for _, chunk := range p.chunks {
+		// The length counts the address. 0, 1, and 2 mean 256, 257, and 258.
+		b = append(b, 0x01, byte(len(chunk.data)+2))
+		b = appendShort(b, chunk.address)
+		b = append(b, chunk.data...)
+	}
+	b = append(b, 0x02, 2)
+	b = appendShort(b, p.entry)
+
+	return b
+}
+
+// Return the bytes after the block's sync byte, up to the next block.
+func (tape *cassetteTape) blockData(i int) []byte {
+	end := len(tape.data)
+	if i+1 < len(tape.blocks) {
+		end = tape.blocks[i+1].sync
+	}
+
+	return tape.data[tape.blocks[i].sync+1 : end]
+}
+
+// Run the "tape" subcommand with its arguments. Returns the exit status.
+func tapeCommand(args []string) int {
+	flags := flag.NewFlagSet("tape", flag.ExitOnError)
+	listBasic := flags.Bool("basic", false, "list BASIC programs")
+	cmdFilename := flags.String("cmd", "", "write the SYSTEM program to this /CMD file")
+	blockNumber := flags.Int("block", 0, "only look at this block (starting at 1)")
+	levelOne := flags.Bool("level1", false, "CAS files are 250-baud Level I tapes")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: trs80emu tape [-basic] [-cmd FILE] [-block N] [-level1] CASSETTE")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	lowSpeedBaud := 500
+	if *levelOne {
+		lowSpeedBaud = 250
+	}
+	tape, err := decodeTape(flags.Arg(0), lowSpeedBaud)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *blockNumber < 0 || *blockNumber > len(tape.blocks) {
+		fmt.Fprintf(os.Stderr, "There are %d blocks on the tape\n", len(tape.blocks))
+		return 1
+	}
+
+	wroteCmd := false
+	for i, block := range tape.blocks {
+		if *blockNumber != 0 && i+1 != *blockNumber {
+			continue
+		}
+		data := tape.blockData(i)
+
+		minutes := int(block.time) / 60
+		fmt.Printf("%2d  %d:%05.2f  %s", i+1, minutes, block.time-float64(minutes*60), block.name)
+
+		switch {
+		case isBasicBlock(data):
+			lines, size, err := parseBasic(data[4:])
+			fmt.Printf("  %d lines, %d bytes, no checksum", len(lines), size)
+			if err != nil {
+				fmt.Printf(", %s", err)
+			}
+			fmt.Println()
+			if *listBasic {
+				for _, line := range lines {
+					fmt.Printf("%d %s\n", line.number, line.text)
+				}
+				fmt.Println()
+			}
+		case isSystemBlock(data):
+			program := parseSystem(data)
+			fmt.Printf("  %s\n", program)
+			if *cmdFilename != "" && !wroteCmd {
+				err = ioutil.WriteFile(*cmdFilename, program.cmdFile(), 0666)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					return 1
+				}
+				fmt.Printf("Wrote \"%s\"\n", *cmdFilename)
+				wroteCmd = true
+			}
+		default:
+			fmt.Printf("  %d bytes\n", len(data))
+		}
+	}
+
+	if *cmdFilename != "" && !wroteCmd {
+		fmt.Fprintln(os.Stderr, "No SYSTEM program on the tape")
+		return 1
+	}
+
+	return 0
+}
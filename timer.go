@@ -2,20 +2,20 @@
 
 package main
 
-// The TRS-80 Model III has a 30 Hz timer that interrupts the CPU. This is used
-// for things like blinking the cursor.
-
-const (
-	timerHz     = 30
-	timerCycles = cpuHz / timerHz
-)
+// The TRS-80 Model III has a 30 Hz timer that interrupts the CPU, and the
+// Model I has a 40 Hz one. This is used for things like blinking the cursor.
 
 // Set or reset the timer interrupt.
 func (vm *vm) timerInterrupt(state bool) {
+	mask := byte(timerIrqMask)
+	if vm.machine.model == model1 {
+		mask = model1TimerIrqMask
+	}
+
 	if state {
-		vm.irqLatch |= timerIrqMask
+		vm.irqLatch |= mask
 	} else {
-		vm.irqLatch &^= timerIrqMask
+		vm.irqLatch &^= mask
 	}
 }
 
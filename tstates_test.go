@@ -0,0 +1,378 @@
+// Copyright 2012 Lawrence Kesteloot
+
+package main
+
+// Checks that each instruction advances the clock by the right number of
+// T-states. The times come from the Zilog manual (UM0080) and, for
+// undocumented instructions, from "The Undocumented Z80 Documented" by Sean
+// Young.
+
+import (
+	"github.com/remogatto/z80"
+	"testing"
+)
+
+// T-states of each instruction, indexed by opcode after the prefix. Zero
+// means there's no such instruction (or it's another prefix). Conditional
+// jumps, calls, and returns and block instructions take the time in the
+// table when they fall through, and the time in the jump table when they
+// jump or repeat.
+var unprefixedTstates = [256]int{
+	4, 10, 7, 6, 4, 4, 7, 4, 4, 11, 7, 6, 4, 4, 7, 4, // 00
+	8, 10, 7, 6, 4, 4, 7, 4, 12, 11, 7, 6, 4, 4, 7, 4, // 10
+	7, 10, 16, 6, 4, 4, 7, 4, 7, 11, 16, 6, 4, 4, 7, 4, // 20
+	7, 10, 13, 6, 11, 11, 10, 4, 7, 11, 13, 6, 4, 4, 7, 4, // 30
+	4, 4, 4, 4, 4, 4, 7, 4, 4, 4, 4, 4, 4, 4, 7, 4, // 40
+	4, 4, 4, 4, 4, 4, 7, 4, 4, 4, 4, 4, 4, 4, 7, 4, // 50
+	4, 4, 4, 4, 4, 4, 7, 4, 4, 4, 4, 4, 4, 4, 7, 4, // 60
+	7, 7, 7, 7, 7, 7, 4, 7, 4, 4, 4, 4, 4, 4, 7, 4, // 70
+	4, 4, 4, 4, 4, 4, 7, 4, 4, 4, 4, 4, 4, 4, 7, 4, // 80
+	4, 4, 4, 4, 4, 4, 7, 4, 4, 4, 4, 4, 4, 4, 7, 4, // 90
+	4, 4, 4, 4, 4, 4, 7, 4, 4, 4, 4, 4, 4, 4, 7, 4, // A0
+	4, 4, 4, 4, 4, 4, 7, 4, 4, 4, 4, 4, 4, 4, 7, 4, // B0
+	5, 10, 10, 10, 10, 11, 7, 11, 5, 10, 10, 0, 10, 17, 7, 11, // C0
+	5, 10, 10, 11, 10, 11, 7, 11, 5, 4, 10, 11, 10, 0, 7, 11, // D0
+	5, 10, 10, 19, 10, 11, 7, 11, 5, 4, 10, 4, 10, 0, 7, 11, // E0
+	5, 10, 10, 4, 10, 11, 7, 11, 5, 6, 10, 4, 10, 0, 7, 11, // F0
+}
+
+var unprefixedJumpTstates = map[byte]int{
+	0x10: 13, // DJNZ
+	0x20: 12, // JR NZ
+	0x28: 12, // JR Z
+	0x30: 12, // JR NC
+	0x38: 12, // JR C
+	0xC0: 11, // RET NZ
+	0xC4: 17, // CALL NZ
+	0xC8: 11, // RET Z
+	0xCC: 17, // CALL Z
+	0xD0: 11, // RET NC
+	0xD4: 17, // CALL NC
+	0xD8: 11, // RET C
+	0xDC: 17, // CALL C
+	0xE0: 11, // RET PO
+	0xE4: 17, // CALL PO
+	0xE8: 11, // RET PE
+	0xEC: 17, // CALL PE
+	0xF0: 11, // RET P
+	0xF4: 17, // CALL P
+	0xF8: 11, // RET M
+	0xFC: 17, // CALL M
+}
+
+var cbTstates = [256]int{
+	8, 8, 8, 8, 8, 8, 15, 8, 8, 8, 8, 8, 8, 8, 15, 8, // 00
+	8, 8, 8, 8, 8, 8, 15, 8, 8, 8, 8, 8, 8, 8, 15, 8, // 10
+	8, 8, 8, 8, 8, 8, 15, 8, 8, 8, 8, 8, 8, 8, 15, 8, // 20
+	8, 8, 8, 8, 8, 8, 15, 8, 8, 8, 8, 8, 8, 8, 15, 8, // 30
+	8, 8, 8, 8, 8, 8, 12, 8, 8, 8, 8, 8, 8, 8, 12, 8, // 40
+	8, 8, 8, 8, 8, 8, 12, 8, 8, 8, 8, 8, 8, 8, 12, 8, // 50
+	8, 8, 8, 8, 8, 8, 12, 8, 8, 8, 8, 8, 8, 8, 12, 8, // 60
+	8, 8, 8, 8, 8, 8, 12, 8, 8, 8, 8, 8, 8, 8, 12, 8, // 70
+	8, 8, 8, 8, 8, 8, 15, 8, 8, 8, 8, 8, 8, 8, 15, 8, // 80
+	8, 8, 8, 8, 8, 8, 15, 8, 8, 8, 8, 8, 8, 8, 15, 8, // 90
+	8, 8, 8, 8, 8, 8, 15, 8, 8, 8, 8, 8, 8, 8, 15, 8, // A0
+	8, 8, 8, 8, 8, 8, 15, 8, 8, 8, 8, 8, 8, 8, 15, 8, // B0
+	8, 8, 8, 8, 8, 8, 15, 8, 8, 8, 8, 8, 8, 8, 15, 8, // C0
+	8, 8, 8, 8, 8, 8, 15, 8, 8, 8, 8, 8, 8, 8, 15, 8, // D0
+	8, 8, 8, 8, 8, 8, 15, 8, 8, 8, 8, 8, 8, 8, 15, 8, // E0
+	8, 8, 8, 8, 8, 8, 15, 8, 8, 8, 8, 8, 8, 8, 15, 8, // F0
+}
+
+// Undefined ED instructions do nothing in 8 T-states.
+var edTstates = [256]int{
+	8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, // 00
+	8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, // 10
+	8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, // 20
+	8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, // 30
+	12, 12, 15, 20, 8, 14, 8, 9, 12, 12, 15, 20, 8, 14, 8, 9, // 40
+	12, 12, 15, 20, 8, 14, 8, 9, 12, 12, 15, 20, 8, 14, 8, 9, // 50
+	12, 12, 15, 20, 8, 14, 8, 18, 12, 12, 15, 20, 8, 14, 8, 18, // 60
+	12, 12, 15, 20, 8, 14, 8, 8, 12, 12, 15, 20, 8, 14, 8, 8, // 70
+	8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, // 80
+	8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, // 90
+	16, 16, 16, 16, 8, 8, 8, 8, 16, 16, 16, 16, 8, 8, 8, 8, // A0
+	16, 16, 16, 16, 8, 8, 8, 8, 16, 16, 16, 16, 8, 8, 8, 8, // B0
+	8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, // C0
+	8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, // D0
+	8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, // E0
+	8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, // F0
+}
+
+var edJumpTstates = map[byte]int{
+	0xB0: 21, // LDIR
+	0xB1: 21, // CPIR
+	0xB2: 21, // INIR
+	0xB3: 21, // OTIR
+	0xB8: 21, // LDDR
+	0xB9: 21, // CPDR
+	0xBA: 21, // INDR
+	0xBB: 21, // OTDR
+}
+
+// Instructions that use IX or IY, including the undocumented ones that use
+// their halves. Other opcodes after DD or FD ignore the prefix, and DD CB
+// and FD CB instructions are in ddcbTstates.
+var ddTstates = [256]int{
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 15, 0, 0, 0, 0, 0, 0, // 00
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 15, 0, 0, 0, 0, 0, 0, // 10
+	0, 14, 20, 10, 8, 8, 11, 0, 0, 15, 20, 10, 8, 8, 11, 0, // 20
+	0, 0, 0, 0, 23, 23, 19, 0, 0, 15, 0, 0, 0, 0, 0, 0, // 30
+	0, 0, 0, 0, 8, 8, 19, 0, 0, 0, 0, 0, 8, 8, 19, 0, // 40
+	0, 0, 0, 0, 8, 8, 19, 0, 0, 0, 0, 0, 8, 8, 19, 0, // 50
+	8, 8, 8, 8, 8, 8, 19, 8, 8, 8, 8, 8, 8, 8, 19, 8, // 60
+	19, 19, 19, 19, 19, 19, 0, 19, 0, 0, 0, 0, 8, 8, 19, 0, // 70
+	0, 0, 0, 0, 8, 8, 19, 0, 0, 0, 0, 0, 8, 8, 19, 0, // 80
+	0, 0, 0, 0, 8, 8, 19, 0, 0, 0, 0, 0, 8, 8, 19, 0, // 90
+	0, 0, 0, 0, 8, 8, 19, 0, 0, 0, 0, 0, 8, 8, 19, 0, // A0
+	0, 0, 0, 0, 8, 8, 19, 0, 0, 0, 0, 0, 8, 8, 19, 0, // B0
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, // C0
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, // D0
+	0, 14, 0, 23, 0, 15, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0, // E0
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 10, 0, 0, 0, 0, 0, 0, // F0
+}
+
+// Indexed by the opcode after the displacement. BIT reads (IX+d); the rest
+// read it and write it back.
+var ddcbTstates = [256]int{
+	23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, // 00
+	23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, // 10
+	23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, // 20
+	23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, // 30
+	20, 20, 20, 20, 20, 20, 20, 20, 20, 20, 20, 20, 20, 20, 20, 20, // 40
+	20, 20, 20, 20, 20, 20, 20, 20, 20, 20, 20, 20, 20, 20, 20, 20, // 50
+	20, 20, 20, 20, 20, 20, 20, 20, 20, 20, 20, 20, 20, 20, 20, 20, // 60
+	20, 20, 20, 20, 20, 20, 20, 20, 20, 20, 20, 20, 20, 20, 20, 20, // 70
+	23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, // 80
+	23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, // 90
+	23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, // A0
+	23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, // B0
+	23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, // C0
+	23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, // D0
+	23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, // E0
+	23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, // F0
+}
+
+const (
+	// Where the instruction under test goes.
+	tstatesCodeBegin = 0x8000
+
+	// Every other byte of memory, so that it's also every operand. It's not
+	// an opcode that follows a prefix, and as a displacement it jumps far
+	// from the instruction.
+	tstatesFiller = 0x90
+)
+
+// Make a machine with no ROM: a Model 4 with 64K of RAM in its all-RAM
+// memory map.
+func createBareVm() *vm {
+	var m *machine
+	for _, m = range machines {
+		if m.model == model4 {
+			break
+		}
+	}
+
+	vm := &vm{
+		machine:      m,
+		memory:       make([]byte, m.memorySize),
+		memInit:      make([]bool, m.memorySize),
+		ramEnd:       m.memorySize,
+		video:        make([]byte, m.videoSize),
+		screenWidth:  64,
+		screenHeight: 16,
+	}
+	vm.z80 = z80.NewZ80(vm, vm)
+	vm.z80.Reset()
+	vm.writeModel4Control(3)
+
+	return vm
+}
+
+// Reset the CPU and memory, put the code at tstatesCodeBegin, and run the
+// given number of its instructions. Return how many T-states they took.
+func runTstates(vm *vm, code []byte, instructions int, flags, b, c byte) int {
+	for i := 0; i < 0x10000; i++ {
+		vm.memory[i] = tstatesFiller
+	}
+	copy(vm.memory[tstatesCodeBegin:], code)
+
+	vm.z80.Reset()
+	vm.z80.SetPC(tstatesCodeBegin)
+	vm.z80.SetSP(0xB000)
+	vm.z80.A = 0x00
+	vm.z80.F = flags
+	vm.z80.B = b
+	vm.z80.C = c
+	vm.z80.D, vm.z80.E = 0xA0, 0x00
+	vm.z80.H, vm.z80.L = 0x90, 0x00
+	vm.z80.IXH, vm.z80.IXL = 0x90, 0x00
+	vm.z80.IYH, vm.z80.IYL = 0x90, 0x00
+
+	clock := vm.clock
+	for i := 0; i < instructions; i++ {
+		tstates := vm.z80.Tstates
+		vm.z80.DoOpcode()
+		vm.addZ80Tstates(tstates)
+	}
+
+	return int(vm.clock - clock)
+}
+
+func TestInstructionTstates(t *testing.T) {
+	vm := createBareVm()
+
+	tables := []struct {
+		prefix      []byte
+		tstates     *[256]int
+		jumpTstates map[byte]int
+	}{
+		{nil, &unprefixedTstates, unprefixedJumpTstates},
+		{[]byte{0xCB}, &cbTstates, nil},
+		{[]byte{0xED}, &edTstates, edJumpTstates},
+		{[]byte{0xDD}, &ddTstates, nil},
+		{[]byte{0xFD}, &ddTstates, nil},
+		{[]byte{0xDD, 0xCB, tstatesFiller}, &ddcbTstates, nil},
+		{[]byte{0xFD, 0xCB, tstatesFiller}, &ddcbTstates, nil},
+	}
+
+	for _, table := range tables {
+		for opcode, want := range table.tstates {
+			if want == 0 {
+				continue
+			}
+			code := append(append([]byte{}, table.prefix...), byte(opcode))
+			jumpTstates, canJump := table.jumpTstates[byte(opcode)]
+
+			// The first state meets the conditions of even-numbered
+			// condition codes (NZ, NC, PO, P), makes DJNZ jump, and ends
+			// BC-counted blocks. The second does the opposite.
+			jumped := map[bool]bool{}
+			for _, state := range [][3]byte{{0x00, 0x00, 0x01}, {0xFF, 0x01, 0x00}} {
+				got := runTstates(vm, code, 1, state[0], state[1], state[2])
+
+				// Instructions are at most four bytes long, so ending up
+				// anywhere else means a jump or a repeat.
+				pc := vm.z80.PC()
+				jump := pc <= tstatesCodeBegin || pc > tstatesCodeBegin+4
+				expected := want
+				if canJump {
+					jumped[jump] = true
+					if jump {
+						expected = jumpTstates
+					}
+				}
+
+				if got != expected {
+					t.Errorf("% X (F=%02X B=%02X C=%02X): %d T-states, expected %d",
+						code, state[0], state[1], state[2], got, expected)
+				}
+			}
+
+			if canJump && len(jumped) != 2 {
+				t.Errorf("% X: only tested with jump=%v", code, jumped)
+			}
+		}
+	}
+}
+
+func TestInterruptTstates(t *testing.T) {
+	vm := createBareVm()
+
+	// The z80 counts the acknowledge cycle itself, and the memory accessors
+	// count the pushes of the PC and the reads of the IM 2 vector.
+	tests := []struct {
+		name          string
+		code          []byte
+		instructions  int
+		nmi           bool
+		tstates       int
+		memoryTstates int
+		pc            uint16
+	}{
+		// The IM 2 vector is read from the filler at 0x00FF.
+		{"IM 1", []byte{0xED, 0x56, 0xFB, 0x00}, 3, false, 13, 6, 0x0038},
+		{"IM 1 while halted", []byte{0xED, 0x56, 0xFB, 0x76}, 3, false, 13, 6, 0x0038},
+		{"IM 2", []byte{0xED, 0x5E, 0xFB, 0x00}, 3, false, 19, 12, 0x9090},
+		{"NMI", []byte{0x00}, 1, true, 11, 6, 0x0066},
+	}
+
+	for _, test := range tests {
+		runTstates(vm, test.code, test.instructions, 0x00, 0x00, 0x00)
+
+		clock := vm.clock
+		tstates := vm.z80.Tstates
+		if test.nmi {
+			vm.z80.NonMaskableInterrupt()
+		} else {
+			vm.z80.Interrupt()
+		}
+		memoryTstates := int(vm.clock - clock)
+		vm.addZ80Tstates(tstates)
+
+		// Check both parts, so that anything counted twice shows up.
+		got := int(vm.clock - clock)
+		if got != test.tstates {
+			t.Errorf("%s: %d T-states, expected %d", test.name, got, test.tstates)
+		}
+		if memoryTstates != test.memoryTstates {
+			t.Errorf("%s: %d T-states from memory accesses, expected %d",
+				test.name, memoryTstates, test.memoryTstates)
+		}
+		if vm.z80.PC() != test.pc {
+			t.Errorf("%s: jumped to %04X, expected %04X", test.name, vm.z80.PC(), test.pc)
+		}
+	}
+}
+
+// Each IN or OUT has an I/O cycle of four T-states.
+func TestPortTstates(t *testing.T) {
+	vm := createBareVm()
+
+	clock := vm.clock
+	vm.WritePort(0x0090, 0x00)
+	vm.ReadPort(0x0000)
+	if got := vm.clock - clock; got != 8 {
+		t.Errorf("Two I/O cycles took %d T-states, expected 8", got)
+	}
+}
+
+// The z80 leaves the timing of I/O instructions to the memory and port
+// accessors, so it shouldn't count any T-states of its own for them.
+func TestIoInstructionTstates(t *testing.T) {
+	vm := createBareVm()
+
+	tests := []struct {
+		name    string
+		code    []byte
+		b, c    byte
+		tstates int
+	}{
+		{"IN A,(n)", []byte{0xDB, 0x00}, 0x00, 0x00, 11},
+		{"OUT (n),A", []byte{0xD3, 0x90}, 0x00, 0x00, 11},
+		{"IN A,(C)", []byte{0xED, 0x78}, 0x00, 0x00, 12},
+		{"OUT (C),A", []byte{0xED, 0x79}, 0x00, 0x90, 12},
+		{"INI", []byte{0xED, 0xA2}, 0x01, 0x00, 16},
+		{"OTIR", []byte{0xED, 0xB3}, 0x01, 0x90, 16},
+		{"OTIR repeating", []byte{0xED, 0xB3}, 0x02, 0x90, 21},
+	}
+
+	for _, test := range tests {
+		runTstates(vm, test.code, 0, 0x00, test.b, test.c)
+
+		clock := vm.clock
+		tstates := vm.z80.Tstates
+		vm.z80.DoOpcode()
+		accessorTstates := int(vm.clock - clock)
+		z80Tstates := vm.z80.Tstates - tstates
+		vm.addZ80Tstates(tstates)
+
+		if got := int(vm.clock - clock); got != test.tstates {
+			t.Errorf("%s: %d T-states, expected %d", test.name, got, test.tstates)
+		}
+		if accessorTstates != test.tstates || z80Tstates != 0 {
+			t.Errorf("%s: %d T-states from accessors and %d from the z80, expected %d and 0",
+				test.name, accessorTstates, z80Tstates, test.tstates)
+		}
+	}
+}
@@ -5,19 +5,14 @@ package main
 // The VM (Virtual Machine) represents the entire machine.
 
 import (
+	"fmt"
 	"github.com/remogatto/z80"
-	"io/ioutil"
 	"log"
+	"strings"
 	"time"
 )
 
 const (
-	// CPU clock on the Model III: 2.02752 MHz.
-	cpuHz = 2027520
-
-	// Nanoseconds per clock cycle.
-	cpuPeriodNs = 1000000000 / cpuHz
-
 	// How many instructions to keep around in a queue so that we can display
 	// the last historicalPcCount instructions when a problem happens.
 	historicalPcCount = 20
@@ -27,19 +22,56 @@ const (
 // That includes the CPU, memory, disk, cassette, keyboard, display, and other
 // parts like the clock interrupt hardware.
 type vm struct {
+	// Which machine we're emulating.
+	machine *machine
+
 	// The CPU state.
 	z80 *z80.Z80
 
-	// All of addressable memory, including ROM, RAM, and memory-mapped I/O
-	// such as the display.
+	// RAM, indexed by address. The Model 4 has a second 64K bank above the
+	// first.
 	memory []byte
 
+	// Index in memory just past the installed RAM. Above that there's
+	// nothing.
+	ramEnd int
+
+	// The ROM, starting at memory location zero.
+	rom []byte
+
+	// Video memory, starting at the top-left of the screen.
+	video []byte
+
+	// Size of the screen, in characters.
+	screenWidth  int
+	screenHeight int
+
+	// Whether characters 0x80 to 0xFF are shown as inverse video instead of
+	// graphics (Model 4).
+	inverseVideo bool
+
+	// The Model 4's memory map, video, and bank register (port 0x84), and
+	// where each 32K half of the address space is in memory.
+	model4Control byte
+	bankOffset    [2]int
+
+	// Whether the CPU is running at double speed (Model 4).
+	fastCpu bool
+
+	// Speed as a multiple of the real machine's, or unlimitedSpeed, and
+	// whether to run at unlimited speed while a motor is running.
+	speed     int
+	autoTurbo bool
+
+	// Whether the UI has paused the machine.
+	paused bool
+
 	// Whether each byte of RAM has been initialized. This is useful for
 	// finding bugs in the emulator. If a program reads too many uninitialized
 	// locations, then it has probably gone off the rails.
 	memInit []bool
 
-	// Size of ROM, starting at memory location zero.
+	// Size of ROM.
 	romSize uint16
 
 	// Which IRQs should be handled.
@@ -69,6 +101,10 @@ type vm struct {
 	// Breakpoints.
 	breakpoints breakpoints
 
+	// Routines we run ourselves instead of emulating them, by PC, wherever
+	// they are in memory. The ROM's are in romHooks.
+	pcHooks map[uint16]pcHook
+
 	// Queued up events.
 	events events
 
@@ -92,12 +128,14 @@ type vm struct {
 	msg string
 
 	// Various fields to periodically debug or adjust the VM.
-	previousDumpTime    time.Time
-	previousDumpClock   uint64
-	sleptSinceDump      time.Duration
-	startTime           int64
-	previousAdjustClock uint64
-	previousTimerClock  uint64
+	previousDumpTime           time.Time
+	previousDumpClock          uint64
+	sleptSinceDump             time.Duration
+	startTime                  int64
+	startClock                 uint64
+	previousAdjustClock        uint64
+	previousSpeed              int
+	previousTimerClock         uint64
 	cassetteRiseInterruptCount uint64
 	cassetteFallInterruptCount uint64
 }
@@ -118,37 +156,48 @@ type vmUpdate struct {
 }
 
 // Creates a new virtual machine. Updates will be sent to vmUpdateCh.
-func createVm(vmUpdateCh chan<- vmUpdate) *vm {
+func createVm(vmUpdateCh chan<- vmUpdate) (*vm, error) {
+	machine, err := selectedMachine()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Emulating the %s", machine.name)
+
 	// Allocate memory.
-	memorySize := 1024 * 64
-	memory := make([]byte, memorySize)
-	memInit := make([]bool, memorySize)
-	log.Printf("Memory has %d bytes", len(memory))
-
-	// Load ROM into memory.
-	romFilename := "roms/model3.rom"
-	rom, err := ioutil.ReadFile(romFilename)
+	ramEnd, err := machine.ramEnd(*ramFlag)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	log.Printf("ROM has %d bytes", len(rom))
+	memory := make([]byte, machine.memorySize)
+	memInit := make([]bool, machine.memorySize)
+	log.Printf("Memory has %d bytes", ramEnd-machine.ramStart)
 
-	// Copy ROM into memory.
-	copy(memory, rom)
+	rom, err := loadRom(machine)
+	if err != nil {
+		return nil, err
+	}
 
 	// Make a CPU.
 	vm := &vm{
-		z80:        nil, // Set below.
-		memory:     memory,
-		memInit:    memInit,
-		romSize:    uint16(len(rom)),
-		vmUpdateCh: vmUpdateCh,
-		modeImage:  0x80,
+		machine:      machine,
+		z80:          nil, // Set below.
+		memory:       memory,
+		memInit:      memInit,
+		ramEnd:       ramEnd,
+		rom:          rom,
+		romSize:      uint16(len(rom)),
+		video:        make([]byte, machine.videoSize),
+		screenWidth:  64,
+		screenHeight: 16,
+		vmUpdateCh:   vmUpdateCh,
+		modeImage:    0x80,
+		speed:        *speedFlag,
+		autoTurbo:    *autoTurboFlag,
 	}
 	vm.z80 = z80.NewZ80(vm, vm)
 	vm.z80.Reset()
 
-	return vm
+	return vm, nil
 }
 
 // Starts a VM. This doesn't boot the machine. It needs to get the
@@ -182,31 +231,84 @@ func (vm *vm) run(vmCommandCh <-chan vmCommand) {
 					vm.vmUpdateCh <- vmUpdate{Cmd: "message", Msg: "Trace is off"}
 				}
 			}
-		case "set_disk0":
-			log.Printf("Loading diskette %s into drive %d", msg.Data, 0)
-			err := vm.loadDisk(0, msg.Data)
-			if err != nil {
-				panic(err)
+		case "set_disk":
+			if msg.Addr >= 0 && msg.Addr < driveCount {
+				log.Printf("Loading diskette %s into drive %d", msg.Data, msg.Addr)
+				err := vm.loadDisk(msg.Addr, msg.Data, *diskOverlays)
+				if err != nil {
+					vm.showError(err)
+				}
+				vm.updateDiskWriteProtect(msg.Addr)
+				vm.updateDiskOverlay(msg.Addr)
 			}
-		case "set_disk1":
-			log.Printf("Loading diskette %s into drive %d", msg.Data, 1)
-			err := vm.loadDisk(1, msg.Data)
-			if err != nil {
-				panic(err)
+		case "set_write_protect":
+			if msg.Addr >= 0 && msg.Addr < driveCount {
+				err := vm.fdc.disks[msg.Addr].setWriteProtected(msg.Data == "true")
+				if err != nil {
+					vm.showError(err)
+				}
+				vm.updateDiskWriteProtect(msg.Addr)
+			}
+		case "disk_discard":
+			if msg.Addr >= 0 && msg.Addr < driveCount {
+				err := vm.fdc.disks[msg.Addr].discard()
+				if err != nil {
+					vm.showError(err)
+				} else {
+					vm.showMessage(fmt.Sprintf("Discarded changes to drive %d", msg.Addr))
+				}
+				vm.updateDiskWriteProtect(msg.Addr)
+			}
+		case "disk_commit":
+			if msg.Addr >= 0 && msg.Addr < driveCount {
+				err := vm.fdc.disks[msg.Addr].commit()
+				if err != nil {
+					vm.showError(err)
+				} else {
+					vm.showMessage(fmt.Sprintf("Saved changes to drive %d", msg.Addr))
+				}
+			}
+		case "disk_save_as":
+			if msg.Addr >= 0 && msg.Addr < driveCount {
+				err := vm.saveDiskAs(msg.Addr, msg.Data)
+				if err != nil {
+					vm.showError(err)
+				} else if vm.vmUpdateCh != nil {
+					vm.vmUpdateCh <- vmUpdate{Cmd: "disk_saved", Addr: msg.Addr,
+						Msg: strings.TrimPrefix(vm.fdc.disks[msg.Addr].filename, "disks/")}
+				}
 			}
 		case "set_cassette":
 			log.Printf("Loading cassette %s", msg.Data)
-			vm.cc.filename = msg.Data
+			vm.loadCassette(msg.Data)
+		case "cassette_seek":
+			// Position in milliseconds.
+			vm.seekCassette(float64(msg.Addr) / 1000)
+		case "set_speed":
+			err := vm.setSpeed(msg.Addr)
+			if err != nil {
+				vm.showError(err)
+			}
+		case "set_autoturbo":
+			vm.setAutoTurbo(msg.Data == "true")
+		case "pause":
+			vm.setPaused(true)
+		case "resume":
+			vm.setPaused(false)
 		default:
 			panic("Unknown VM command " + msg.Cmd)
 		}
 	}
 
+	vm.updateSpeedSettings()
+
 	for !shutdown {
-		if running {
+		if running && !vm.paused {
 			select {
 			case msg := <-vmCommandCh:
 				handleCmd(msg)
+			case decoding := <-vm.cc.tapeCh:
+				vm.setCassetteTape(decoding)
 			default:
 				// See if there's a breakpoint here.
 				bp := vm.breakpoints.find(vm.z80.PC())
@@ -222,7 +324,12 @@ func (vm *vm) run(vmCommandCh <-chan vmCommand) {
 				}
 			}
 		} else {
-			handleCmd(<-vmCommandCh)
+			select {
+			case msg := <-vmCommandCh:
+				handleCmd(msg)
+			case decoding := <-vm.cc.tapeCh:
+				vm.setCassetteTape(decoding)
+			}
 		}
 	}
 
@@ -237,6 +344,19 @@ func (vm *vm) run(vmCommandCh <-chan vmCommand) {
 	vm.vmUpdateCh = nil
 }
 
+// Log an error and show it to the user.
+func (vm *vm) showError(err error) {
+	vm.showMessage(err.Error())
+}
+
+// Log a message and show it to the user.
+func (vm *vm) showMessage(msg string) {
+	log.Print(msg)
+	if vm.vmUpdateCh != nil {
+		vm.vmUpdateCh <- vmUpdate{Cmd: "message", Msg: msg}
+	}
+}
+
 // Log the last historicalPcCount assembly instructions that we executed.
 func (vm *vm) logHistoricalPc() {
 	for i := 0; i < historicalPcCount; i++ {
@@ -254,10 +374,14 @@ func (vm *vm) reset(powerOn bool) {
 	vm.setNmiMask(0)
 	vm.keyboard.clearKeyboard()
 	vm.timerInterrupt(false)
+	if vm.machine.model == model4 {
+		vm.writeModel4Control(0)
+		vm.setFastCpu(false)
+	}
 
 	if powerOn {
 		vm.z80.Reset()
-		vm.startTime = time.Now().UnixNano()
+		vm.resetThrottle()
 	} else {
 		vm.resetButtonInterrupt(true)
 	}
@@ -2,128 +2,213 @@
 
 package main
 
-// Parse .WAV files for cassette support.
+// Parse and write .WAV files for cassette support.
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
 )
 
+// Sample formats in the fmt chunk.
+const (
+	wavFormatPcm        = 1
+	wavFormatFloat      = 3
+	wavFormatExtensible = 0xFFFE
+)
+
 // Holds information about the WAV file.
 type wavFile struct {
-	io.ReadSeeker
+	f                *os.File
+	r                *bufio.Reader
+	format           uint16
 	channelCount     uint16
 	samplesPerSecond uint32
-	bytesPerSample   uint16
+	bytesPerFrame    uint16
 	bitsPerSample    uint16
+	dataStart        int64  // Offset of the samples in the file.
+	dataSize         uint32 // Size of the data chunk.
+	dataLeft         uint32 // Bytes left in the data chunk.
+	frame            []byte
 	isEof            bool
 }
 
-// Parses .WAV file headers.
-func openWav(filename string) (w *wavFile, err error) {
+// Parses .WAV file headers, walking the chunks until the data chunk.
+func openWav(filename string) (*wavFile, error) {
 	// Open the file.
 	f, err := os.Open(filename)
 	if err != nil {
-		return
+		return nil, err
+	}
+
+	w := &wavFile{f: f, r: bufio.NewReader(f)}
+	err = w.parseHeader()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Can't read WAV file \"%s\": %s", filename, err)
 	}
 
-	w = &wavFile{f, 0, 0, 0, 0, false}
+	log.Printf("Loaded WAV cassette \"%s\" (%d Hz, %d channels, %d bits)",
+		filename, w.samplesPerSecond, w.channelCount, w.bitsPerSample)
+
+	return w, nil
+}
 
-	// Parse header.
-	err = w.parseChunkId("RIFF")
+// Parse the chunks up to the start of the samples.
+func (w *wavFile) parseHeader() error {
+	err := w.parseChunkId("RIFF")
 	if err != nil {
-		return
+		return err
 	}
 	// Length of the rest of the file.
 	_, err = w.parseInt()
 	if err != nil {
-		return
+		return err
 	}
 	err = w.parseChunkId("WAVE")
 	if err != nil {
-		return
-	}
-	err = w.parseChunkId("fmt ")
-	if err != nil {
-		return
-	}
-	// Format chunk size.
-	chunkSize, err := w.parseInt()
-	if err != nil {
-		return
-	}
-	// Format.
-	format, err := w.parseShort()
-	if err != nil {
-		return
-	}
-	if format != 1 {
-		panic(fmt.Sprintf("We only handle PCM format (1), not %d", format))
-	}
-	// Number of channels.
-	w.channelCount, err = w.parseShort()
-	if err != nil {
-		return
+		return err
 	}
-	// Sample rate.
-	w.samplesPerSecond, err = w.parseInt()
-	if err != nil {
-		return
+
+	haveFormat := false
+	for {
+		chunkId, err := w.readChunkId()
+		if err == io.EOF {
+			return fmt.Errorf("No data chunk")
+		} else if err != nil {
+			return err
+		}
+		chunkSize, err := w.parseInt()
+		if err != nil {
+			return err
+		}
+
+		switch chunkId {
+		case "fmt ":
+			err = w.parseFormat(chunkSize)
+			if err != nil {
+				return err
+			}
+			haveFormat = true
+		case "data":
+			if !haveFormat {
+				return fmt.Errorf("Data chunk before fmt chunk")
+			}
+			pos, err := w.f.Seek(0, 1)
+			if err != nil {
+				return err
+			}
+			w.dataStart = pos - int64(w.r.Buffered())
+			w.dataSize = chunkSize
+			w.dataLeft = chunkSize
+			return nil
+		default:
+			// LIST, fact, and so on.
+			if wavDebug {
+				log.Printf("Skipping \"%s\" chunk (%d bytes)", chunkId, chunkSize)
+			}
+			err = w.skip(chunkSize)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Chunks are padded to an even size.
+		if chunkSize%2 != 0 {
+			err = w.skip(1)
+			if err != nil {
+				return err
+			}
+		}
 	}
-	// Ignore this int.
-	_, err = w.parseInt()
-	if err != nil {
-		return
+}
+
+// Parse the fmt chunk of the given size and check that we can read its samples.
+func (w *wavFile) parseFormat(chunkSize uint32) error {
+	if chunkSize < 16 {
+		return fmt.Errorf("fmt chunk is too short (%d bytes)", chunkSize)
 	}
-	// Bytes per sample.
-	w.bytesPerSample, err = w.parseShort()
+
+	b := make([]byte, chunkSize)
+	_, err := io.ReadFull(w.r, b)
 	if err != nil {
-		return
+		return err
 	}
-	// Bits per sample.
-	w.bitsPerSample, err = w.parseShort()
-	if err != nil {
-		return
+
+	w.format = uint16(b[0]) | uint16(b[1])<<8
+	w.channelCount = uint16(b[2]) | uint16(b[3])<<8
+	w.samplesPerSecond = readLittleEndian32(b[4:])
+	// Skip bytes per second.
+	w.bytesPerFrame = uint16(b[12]) | uint16(b[13])<<8
+	w.bitsPerSample = uint16(b[14]) | uint16(b[15])<<8
+
+	// The extensible format keeps the real format in the first two bytes of
+	// its sub-format GUID.
+	if w.format == wavFormatExtensible {
+		if chunkSize < 40 {
+			return fmt.Errorf("Extensible fmt chunk is too short (%d bytes)", chunkSize)
+		}
+		w.format = uint16(b[24]) | uint16(b[25])<<8
 	}
-	// Read rest of format chunk.
-	chunkSize -= 16 // Amount read already.
-	if chunkSize > 0 {
-		if wavDebug {
-			log.Printf("Skipping %d bytes in fmt chunk", chunkSize)
+
+	switch w.format {
+	case wavFormatPcm:
+		if w.bitsPerSample != 8 && w.bitsPerSample != 16 &&
+			w.bitsPerSample != 24 && w.bitsPerSample != 32 {
+
+			return fmt.Errorf("Can't handle %d-bit PCM samples", w.bitsPerSample)
 		}
-		b := make([]byte, chunkSize)
-		_, err = io.ReadFull(w, b)
-		if err != nil {
-			return
+	case wavFormatFloat:
+		if w.bitsPerSample != 32 && w.bitsPerSample != 64 {
+			return fmt.Errorf("Can't handle %d-bit float samples", w.bitsPerSample)
 		}
+	default:
+		return fmt.Errorf("Can't handle format %d, only PCM (1) and float (3)", w.format)
 	}
-	// Start data chunk.
-	err = w.parseChunkId("data")
-	if err != nil {
-		return
+
+	if w.channelCount == 0 {
+		return fmt.Errorf("No channels")
 	}
-	// Size of data chunk.
-	_, err = w.parseInt()
+	if w.samplesPerSecond == 0 {
+		return fmt.Errorf("Sample rate is zero")
+	}
+	if int(w.bytesPerFrame) < int(w.channelCount)*int(w.bitsPerSample/8) {
+		return fmt.Errorf("Block size %d is too small for %d channels of %d bits",
+			w.bytesPerFrame, w.channelCount, w.bitsPerSample)
+	}
+	w.frame = make([]byte, w.bytesPerFrame)
+
+	return nil
+}
+
+// Skip the given number of bytes.
+func (w *wavFile) skip(count uint32) error {
+	_, err := w.r.Discard(int(count))
+	return err
+}
+
+// Read a 4-byte ASCII chunk ID.
+func (w *wavFile) readChunkId() (string, error) {
+	b := make([]byte, 4)
+	_, err := io.ReadFull(w.r, b)
 	if err != nil {
-		return
+		return "", err
 	}
 
-	return
+	return string(b), nil
 }
 
 // Parse a 4-byte ASCII chunk ID and verify that it matches the given ID.
 func (w *wavFile) parseChunkId(expectedChunkId string) error {
-	// Read four bytes.
-	b := make([]byte, 4)
-	_, err := io.ReadFull(w, b)
+	foundChunkId, err := w.readChunkId()
 	if err != nil {
 		return err
 	}
 
 	// Compare to expected chunk ID.
-	foundChunkId := string(b)
 	if foundChunkId != expectedChunkId {
 		return fmt.Errorf("Expected chunk ID \"%s\" but got \"%s\"", expectedChunkId, foundChunkId)
 	}
@@ -139,13 +224,13 @@ func (w *wavFile) parseChunkId(expectedChunkId string) error {
 func (w *wavFile) parseInt() (uint32, error) {
 	// Read four bytes.
 	b := make([]byte, 4)
-	_, err := io.ReadFull(w, b)
+	_, err := io.ReadFull(w.r, b)
 	if err != nil {
 		return 0, err
 	}
 
 	// Little-endian.
-	n := uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+	n := readLittleEndian32(b)
 
 	if wavDebug {
 		log.Printf("Found 4-byte integer %d (0x%08X)", n, n)
@@ -154,53 +239,181 @@ func (w *wavFile) parseInt() (uint32, error) {
 	return n, nil
 }
 
-// Loads a 2-byte little-endian int.
-func (w *wavFile) parseShort() (uint16, error) {
-	// Read two bytes.
-	b := make([]byte, 2)
-	_, err := io.ReadFull(w, b)
-	if err != nil {
-		return 0, err
-	}
+// Return the number of samples per second.
+func (w *wavFile) sampleRate() uint32 {
+	return w.samplesPerSecond
+}
 
-	// Little-endian.
-	n := uint16(b[0]) | uint16(b[1])<<8
+// Go to the given sample, or to the end of the samples if it's past them.
+func (w *wavFile) seekSample(n int) error {
+	offset := int64(n) * int64(w.bytesPerFrame)
+	if offset > int64(w.dataSize) {
+		offset = int64(w.dataSize)
+	}
 
-	if wavDebug {
-		log.Printf("Found 2-byte integer %d (0x%04X)", n, n)
+	_, err := w.f.Seek(w.dataStart+offset, 0)
+	if err != nil {
+		return err
 	}
+	w.r.Reset(w.f)
+	w.dataLeft = w.dataSize - uint32(offset)
+	w.isEof = false
 
-	return n, nil
+	return nil
 }
 
-// Loads a sample.
-func (w *wavFile) readSample() (int16, error) {
-	// Only handle simple case.
-	if w.channelCount != 1 {
-		panic("We only handle mono WAV files")
-	}
-	if w.bytesPerSample != 2 {
-		panic("We only handle WAV files with two bytes per sample")
-	}
-	if w.bitsPerSample != 16 {
-		panic("We only handle 16-bit WAV files")
-	}
+// Closes the file.
+func (w *wavFile) close() error {
+	return w.f.Close()
+}
 
+// Loads a sample, mixing all channels down to one 16-bit value.
+func (w *wavFile) readSample() (int16, error) {
 	if w.isEof {
-		// Pretend that the tape stopped and that we're just
-		// reading silence. That's probably what the original
-		// computer did.
-		return 0, nil
+		return 0, io.EOF
 	}
 
-	s, err := w.parseShort()
-	if err == io.EOF {
+	if w.dataLeft < uint32(w.bytesPerFrame) {
 		log.Print("End of cassette")
 		w.isEof = true
-		return 0, nil
+		return 0, io.EOF
+	}
+	_, err := io.ReadFull(w.r, w.frame)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		log.Print("End of cassette")
+		w.isEof = true
+		return 0, io.EOF
 	} else if err != nil {
 		return 0, err
 	}
+	w.dataLeft -= uint32(w.bytesPerFrame)
+
+	// Average the channels.
+	bytesPerSample := int(w.bitsPerSample / 8)
+	var sum float64
+	for channel := 0; channel < int(w.channelCount); channel++ {
+		sum += w.convertSample(w.frame[channel*bytesPerSample:])
+	}
+	s := sum / float64(w.channelCount)
+
+	// Float samples can go past full scale.
+	if s > 32767 {
+		s = 32767
+	} else if s < -32768 {
+		s = -32768
+	}
 
 	return int16(s), nil
 }
+
+// Convert the sample at the start of b to the range of a 16-bit sample.
+func (w *wavFile) convertSample(b []byte) float64 {
+	if w.format == wavFormatFloat {
+		if w.bitsPerSample == 64 {
+			bits := uint64(readLittleEndian32(b)) | uint64(readLittleEndian32(b[4:]))<<32
+			return math.Float64frombits(bits) * 32767
+		}
+		return float64(math.Float32frombits(readLittleEndian32(b))) * 32767
+	}
+
+	switch w.bitsPerSample {
+	case 8:
+		// Unsigned.
+		return float64((int(b[0]) - 128) << 8)
+	case 16:
+		return float64(int16(uint16(b[0]) | uint16(b[1])<<8))
+	case 24:
+		// Keep the top 16 bits.
+		return float64(int16(uint16(b[1]) | uint16(b[2])<<8))
+	default:
+		return float64(int32(readLittleEndian32(b))) / 65536
+	}
+}
+
+// Writes a 16-bit mono PCM .WAV file.
+type wavWriter struct {
+	f                *os.File
+	w                *bufio.Writer
+	samplesPerSecond uint32
+	sampleCount      int
+}
+
+// Creates a .WAV file. The header is filled in when the file is closed.
+func createWav(filename string, samplesPerSecond uint32) (*wavWriter, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &wavWriter{f, bufio.NewWriter(f), samplesPerSecond, 0}
+
+	// Placeholder header, rewritten by close().
+	err = w.writeHeader()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Write the 44-byte header for the samples written so far.
+func (w *wavWriter) writeHeader() error {
+	const bytesPerSample = 2
+	dataSize := uint32(w.sampleCount * bytesPerSample)
+
+	header := make([]byte, 0, 44)
+	header = append(header, "RIFF"...)
+	header = appendInt(header, 36+dataSize) // Length of the rest of the file.
+	header = append(header, "WAVE"...)
+	header = append(header, "fmt "...)
+	header = appendInt(header, 16)  // Format chunk size.
+	header = appendShort(header, 1) // PCM format.
+	header = appendShort(header, 1) // Mono.
+	header = appendInt(header, w.samplesPerSecond)
+	header = appendInt(header, w.samplesPerSecond*bytesPerSample) // Bytes per second.
+	header = appendShort(header, bytesPerSample)
+	header = appendShort(header, 8*bytesPerSample) // Bits per sample.
+	header = append(header, "data"...)
+	header = appendInt(header, dataSize)
+
+	_, err := w.w.Write(header)
+	return err
+}
+
+// Writes a sample.
+func (w *wavWriter) writeSample(s int16) error {
+	w.sampleCount++
+	w.w.WriteByte(byte(s))
+	return w.w.WriteByte(byte(s >> 8))
+}
+
+// Fills in the header and closes the file.
+func (w *wavWriter) close() error {
+	err := w.w.Flush()
+	if err == nil {
+		_, err = w.f.Seek(0, 0)
+	}
+	if err == nil {
+		err = w.writeHeader()
+	}
+	if err == nil {
+		err = w.w.Flush()
+	}
+	closeErr := w.f.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// Appends a 4-byte little-endian int.
+func appendInt(b []byte, n uint32) []byte {
+	return append(b, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+}
+
+// Appends a 2-byte little-endian int.
+func appendShort(b []byte, n uint16) []byte {
+	return append(b, byte(n), byte(n>>8))
+}
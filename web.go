@@ -11,6 +11,8 @@ import (
 	"fmt"
 	"github.com/lkesteloot/goutil/sortutil"
 	"github.com/lkesteloot/goutil/webutil"
+	"image"
+	"image/png"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -59,6 +61,10 @@ div.screen.expanded .char {
 div.screen.expanded .odd-column {
 	display: none;
 }
+
+div.screen .char.inverse {
+	background-image: url("font-inverse.png");
+}
 `)
 	for ch := 0; ch < 256; ch++ {
 		fmt.Fprintf(bw, "div.screen.narrow .char-%d { background-position: %dpx %dpx; }\n",
@@ -69,9 +75,34 @@ div.screen.expanded .odd-column {
 	bw.Flush()
 }
 
-// Append files in a directory matching an extension to a list of pathnames.
-// Recurses into subdirectories.
-func addDirectory(pathnames *[]string, prefixPath, dir, extension string) {
+// Generate the font image with its two colors swapped, for inverse video.
+func generateInverseFont(w http.ResponseWriter, r *http.Request) {
+	f, err := os.Open("static/font.png")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	img, err := png.Decode(f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	font, ok := img.(*image.Paletted)
+	if !ok || len(font.Palette) != 2 {
+		http.Error(w, "Font must have two colors", http.StatusInternalServerError)
+		return
+	}
+	font.Palette[0], font.Palette[1] = font.Palette[1], font.Palette[0]
+
+	w.Header().Set("Content-Type", "image/png")
+	png.Encode(w, font)
+}
+
+// Append files in a directory matching any of the extensions to a list of
+// pathnames. Recurses into subdirectories.
+func addDirectory(pathnames *[]string, prefixPath, dir string, extensions []string) {
 	// Get list of files.
 	fileInfos, err := ioutil.ReadDir(dir)
 	if err != nil {
@@ -86,10 +117,13 @@ func addDirectory(pathnames *[]string, prefixPath, dir, extension string) {
 
 			if fileInfo.IsDir() {
 				addDirectory(pathnames, path.Join(prefixPath, filename),
-					path.Join(dir, filename), extension)
+					path.Join(dir, filename), extensions)
 			} else {
-				if path.Ext(filename) == extension {
-					*pathnames = append(*pathnames, path.Join(prefixPath, filename))
+				ext := path.Ext(filename)
+				for _, extension := range extensions {
+					if ext == extension {
+						*pathnames = append(*pathnames, path.Join(prefixPath, filename))
+					}
 				}
 			}
 		}
@@ -97,10 +131,10 @@ func addDirectory(pathnames *[]string, prefixPath, dir, extension string) {
 }
 
 // Generate a JSON document of files in a directory tree.
-func generateFileList(w http.ResponseWriter, r *http.Request, dir, extension string) {
+func generateFileList(w http.ResponseWriter, r *http.Request, dir string, extensions ...string) {
 	// Get list of pathnames.
 	pathnames := []string{}
-	addDirectory(&pathnames, ".", dir, extension)
+	addDirectory(&pathnames, ".", dir, extensions)
 
 	// JSON-encoded.
 	w.Header().Set("Content-Type", "application/json")
@@ -114,10 +148,12 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
 		generateIndex(w, r)
 	case "/font.css":
 		generateFontCss(w, r)
+	case "/font-inverse.png":
+		generateInverseFont(w, r)
 	case "/disks.json":
-		generateFileList(w, r, "disks", ".dsk")
+		generateFileList(w, r, "disks", ".dsk", ".dmk")
 	case "/cassettes.json":
-		generateFileList(w, r, *cassettesDir, ".wav")
+		generateFileList(w, r, *cassettesDir, ".wav", ".cas")
 	default:
 		http.NotFound(w, r)
 	}
@@ -148,8 +184,14 @@ func readWs(ws *websocket.Conn, vmCommandCh chan<- vmCommand) {
 func wsHandler(ws *websocket.Conn) {
 	vmCommandCh := make(chan vmCommand)
 	vmUpdateCh := make(chan vmUpdate)
+	vm, err := createVm(vmUpdateCh)
+	if err != nil {
+		// Tell the user why nothing works.
+		log.Print(err)
+		websocket.JSON.Send(ws, []vmUpdate{{Cmd: "message", Msg: err.Error()}})
+		return
+	}
 	go readWs(ws, vmCommandCh)
-	vm := createVm(vmUpdateCh)
 	go vm.run(vmCommandCh)
 
 	// Batch updates.
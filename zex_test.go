@@ -0,0 +1,139 @@
+// Copyright 2012 Lawrence Kesteloot
+
+package main
+
+// Runs Frank Cringle's Z80 instruction exercisers: ZEXDOC, which checks the
+// documented flags, and ZEXALL, which checks all of them. They're CP/M
+// programs, so we load them into a machine with no ROM and do CP/M's console
+// output ourselves. They aren't in the repo; put zexdoc.com or zexall.com in
+// the testdata directory to run them. They take minutes, so -short skips them.
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+const (
+	// Jumping here ends the program.
+	cpmWarmBoot = 0x0000
+
+	// Programs call here for operating system services, with the function
+	// in C.
+	cpmBdos = 0x0005
+
+	// Programs are loaded and run here.
+	cpmTpa = 0x0100
+
+	// Top of the memory available to programs. Programs find it in the jump
+	// at cpmBdos and put their stack there.
+	cpmTpaEnd = 0xF000
+
+	// Give up on a program that hasn't exited after this many T-states.
+	// ZEXALL takes about 46 billion.
+	cpmMaxClock = 100e9
+)
+
+// BDOS functions.
+const (
+	cpmConsoleOutput = 2 // Print E.
+	cpmPrintString   = 9 // Print (DE), terminated by '$'.
+)
+
+// Run a CP/M program on a machine with no ROM until it exits, and return
+// what it printed. Each line is passed to lineFunc as it's completed.
+func runCpm(t *testing.T, program []byte, lineFunc func(line string)) string {
+	var output, line []byte
+	printChar := func(ch byte) {
+		output = append(output, ch)
+		if ch == '\n' {
+			lineFunc(strings.TrimRight(string(line), "\r"))
+			line = line[:0]
+		} else {
+			line = append(line, ch)
+		}
+	}
+
+	// Operating system routines, which we run ourselves.
+	done := false
+	hooks := map[uint16]pcHook{
+		cpmWarmBoot: func(vm *vm) bool {
+			done = true
+			return true
+		},
+		cpmBdos: func(vm *vm) bool {
+			switch vm.z80.C {
+			case cpmConsoleOutput:
+				printChar(vm.z80.E)
+			case cpmPrintString:
+				addr := uint16(vm.z80.D)<<8 | uint16(vm.z80.E)
+				for ch := vm.readMem(addr); ch != '$'; ch = vm.readMem(addr) {
+					printChar(ch)
+					addr++
+				}
+			}
+
+			vm.simulateRet()
+			return true
+		},
+	}
+
+	vm := createBareVm()
+	vm.pcHooks = hooks
+	copy(vm.memory[cpmTpa:], program)
+	vm.memory[cpmBdos] = 0xC3 // JP
+	vm.memory[cpmBdos+1] = cpmTpaEnd & 0xFF
+	vm.memory[cpmBdos+2] = cpmTpaEnd >> 8
+
+	vm.z80.SetPC(cpmTpa)
+	for !done {
+		if vm.clock > cpmMaxClock {
+			t.Fatalf("Program didn't exit after %d T-states:\n%s", vm.clock, output)
+		}
+		vm.runInstruction()
+	}
+
+	return string(output)
+}
+
+func testExerciser(t *testing.T, filename string) {
+	if testing.Short() {
+		t.Skip("Skipping instruction exerciser in short mode")
+	}
+
+	pathname := path.Join("testdata", filename)
+	program, err := ioutil.ReadFile(pathname)
+	if os.IsNotExist(err) {
+		t.Skipf("Put %s in testdata to run it", filename)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each instruction group gets a line, ending in OK or an error with the
+	// expected and actual CRCs.
+	groups := 0
+	output := runCpm(t, program, func(line string) {
+		if strings.Contains(line, "ERROR") {
+			t.Error(line)
+			groups++
+		} else if strings.HasSuffix(line, "OK") {
+			t.Log(line)
+			groups++
+		}
+	})
+
+	if groups == 0 {
+		t.Errorf("%s didn't test anything:\n%s", filename, output)
+	}
+}
+
+func TestZexdoc(t *testing.T) {
+	testExerciser(t, "zexdoc.com")
+}
+
+func TestZexall(t *testing.T) {
+	testExerciser(t, "zexall.com")
+}